@@ -2,25 +2,102 @@ package client
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/bytedance/gopkg/lang/mcache"
 	constants "github.com/mgeri/udptunneler/pkg"
+	"github.com/mgeri/udptunneler/pkg/auth"
+	"github.com/mgeri/udptunneler/pkg/compress"
+	"github.com/mgeri/udptunneler/pkg/dedup"
+	"github.com/mgeri/udptunneler/pkg/encrypt"
 	"github.com/mgeri/udptunneler/pkg/frame"
+	"github.com/mgeri/udptunneler/pkg/handshake"
+	"github.com/mgeri/udptunneler/pkg/mcast"
 	"github.com/mgeri/udptunneler/pkg/packet"
+	"github.com/mgeri/udptunneler/pkg/publisher"
+	"github.com/mgeri/udptunneler/pkg/queue"
+	"github.com/mgeri/udptunneler/pkg/route"
+	"github.com/mgeri/udptunneler/pkg/sequence"
+	"github.com/mgeri/udptunneler/pkg/transport"
 	"github.com/mgeri/udptunneler/pkg/util"
 	"github.com/spf13/cobra"
-	"golang.org/x/net/ipv4"
 	"time"
 
 	"log"
+	"math"
 	"net"
+	"os"
 	"strings"
+	"sync/atomic"
 )
 
+const publisherIdleTimeout = 5 * time.Minute
+
+// errReverseRefused is returned when the server does not grant the reverse mode, because it joins no channel
+var errReverseRefused = &packet.Error{
+	Code:    packet.ErrorCodeBadRequest,
+	Message: "reverse mode not available, the server joins no channel",
+}
+
+// errEncryptionRefused is returned when the server does not grant the encryption, the frames are never sent in clear
+var errEncryptionRefused = &packet.Error{
+	Code:    packet.ErrorCodeUnauthorized,
+	Message: "encryption not available, the server does not authenticate the clients or does not support it",
+}
+
 var (
-	udpInterface  string
-	udpAddress    string
-	serverAddress string
-	dumpBytes     bool
+	udpInterface       string
+	udpAddresses       []string
+	udpSources         []string
+	udpExcludedSources []string
+	serverAddress      string
+	serverScheme       string // tcp or quic
+	serverHost         string // host:port of the server address
+	clientID           string
+	dumpBytes          bool
+	maxDatagramSize    int
+
+	reverse       bool
+	mcastTTL      int
+	mcastHopLimit int
+	mcastLoopback bool
+	bridge        bool
+	dedupWindow   time.Duration
+	publishers    *publisher.Registry
+	published     *dedup.Cache
+	looped        uint64 // datagrams published by the client and re-captured from the joined channels
+
+	tlsEnabled    bool
+	tlsCert       string
+	tlsKey        string
+	tlsCA         string
+	tlsServerName string
+	tlsConfig     *tls.Config
+	keyFile       string
+	key           []byte
+	encryption    bool
+
+	quicDatagramGroups []string
+	quicDatagrams      []*route.Match
+
+	queueSize         int
+	queuePolicy       string
+	reconnectMin      time.Duration
+	reconnectMax      time.Duration
+	reconnectJitter   float64
+	reconnectAttempts int
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	batchCount        int
+	batchSize         int
+	batchLinger       time.Duration
+	statsInterval     time.Duration
+
+	compression     bool
+	compressLevel   string
+	compressDict    string
+	compressOptions *compress.Options
 
 	Cmd = &cobra.Command{
 		Use:   "client",
@@ -33,172 +110,563 @@ var (
 func init() {
 
 	Cmd.PersistentFlags().StringVarP(&udpInterface, "interface", "i", "",
-		"the network interface used to join the provided multicast channel provided")
-	Cmd.PersistentFlags().StringVarP(&udpAddress, "address", "a", "",
-		"the udp destination IP and port of the channel we want to join")
+		"the network interface used to join the multicast channels without an explicit interface, or to publish the datagrams in reverse mode")
+	Cmd.PersistentFlags().StringSliceVarP(&udpAddresses, "address", "a", nil,
+		"the udp destination IP and port of the channel we want to join, as ip:port[@interface]. Can be repeated or comma separated to join many channels")
+	Cmd.PersistentFlags().StringSliceVar(&udpSources, "source", nil,
+		"the source IP of a source-specific multicast (S,G) channel. Can be repeated or comma separated, applied to all the channels")
+	Cmd.PersistentFlags().StringSliceVar(&udpExcludedSources, "exclude-source", nil,
+		"the source IP whose datagrams are blocked on any-source channels. Can be repeated or comma separated, applied to all the channels")
 	Cmd.PersistentFlags().StringVarP(&serverAddress, "server", "s", "",
-		"the tcp address (ip:port) of the server to which the datagram will be forwarded")
+		"the address of the server to which the datagrams are forwarded, as [tcp://]host:port, or quic://host:port to connect with QUIC (always tls, with a stream per group)")
+	Cmd.PersistentFlags().StringVar(&clientID, "id", "",
+		"the client id sent to the server during the handshake (default the hostname)")
 	Cmd.PersistentFlags().BoolVarP(&dumpBytes, "dump", "d", false,
 		"dump the raw bytes of the message")
+	Cmd.PersistentFlags().IntVar(&maxDatagramSize, "max-datagram-size", constants.DefaultDatagramSize,
+		"the max size of the datagrams received from the multicast channels, larger datagrams are discarded (max 65507)")
+	Cmd.PersistentFlags().BoolVar(&reverse, "reverse", false,
+		"reverse mode: receive the datagrams of the channels joined by the server and publish them on the same channels")
+	Cmd.PersistentFlags().BoolVar(&bridge, "bridge", false,
+		"bridge mode: forward the joined channels to the server and publish the channels joined by the server, like the reverse mode")
+	Cmd.PersistentFlags().DurationVar(&dedupWindow, "dedup-window", time.Second,
+		"the time a datagram published in bridge mode is remembered, to discard it when re-captured from the joined channels instead of sending it back to the server (0 = disabled)")
+	Cmd.PersistentFlags().IntVar(&mcastTTL, "ttl", 1,
+		"the time to live of the datagrams published on IPv4 multicast groups in reverse mode")
+	Cmd.PersistentFlags().IntVar(&mcastHopLimit, "hop-limit", 1,
+		"the hop limit of the datagrams published on IPv6 multicast groups in reverse mode")
+	Cmd.PersistentFlags().BoolVar(&mcastLoopback, "loopback", true,
+		"loop back the multicast datagrams published in reverse mode to the receivers on the client host")
+	Cmd.PersistentFlags().IntVar(&queueSize, "queue-size", 1024,
+		"the max number of datagrams buffered while waiting to be sent to the server")
+	Cmd.PersistentFlags().StringVar(&queuePolicy, "queue-policy", queue.PolicyDropOldest,
+		"the datagram dropped when the queue is full: "+queue.PolicyDropOldest+" or "+queue.PolicyDropNewest)
+	Cmd.PersistentFlags().DurationVar(&reconnectMin, "reconnect-min", 1*time.Second,
+		"the delay before the first reconnection attempt")
+	Cmd.PersistentFlags().DurationVar(&reconnectMax, "reconnect-max", 30*time.Second,
+		"the max delay between reconnection attempts")
+	Cmd.PersistentFlags().Float64Var(&reconnectJitter, "reconnect-jitter", 0.2,
+		"the random fraction (0..1) added or subtracted to the reconnection delay")
+	Cmd.PersistentFlags().IntVar(&reconnectAttempts, "reconnect-attempts", 0,
+		"the max number of consecutive reconnection attempts before giving up (0 = retry forever)")
+	Cmd.PersistentFlags().DurationVar(&heartbeatInterval, "heartbeat-interval", constants.DefaultHeartbeatInterval*time.Second,
+		"the interval between the heartbeats sent to the server")
+	Cmd.PersistentFlags().DurationVar(&heartbeatTimeout, "heartbeat-timeout", constants.DefaultHeartbeatTimeout*time.Second,
+		"the time without any packet after which the connection is considered dead and re-established, announced to the server too")
+	Cmd.PersistentFlags().IntVar(&batchCount, "batch-count", 64,
+		"the max number of datagrams packed into a single frame (1 = no batching)")
+	Cmd.PersistentFlags().IntVar(&batchSize, "batch-size", 16384,
+		"the max number of bytes of a batch of datagrams")
+	Cmd.PersistentFlags().DurationVar(&batchLinger, "batch-linger", 0,
+		"the max time a datagram waits for other datagrams to fill the batch (0 = the batch is sent as soon as the queue is empty)")
+	Cmd.PersistentFlags().DurationVar(&statsInterval, "stats-interval", 0,
+		"the interval between the logs of the statistics of the joined channels and of the queue (0 = disabled)")
+	Cmd.PersistentFlags().BoolVar(&compression, "compress", false,
+		"compress the frames sent to the server and received from it, if supported by the server")
+	Cmd.PersistentFlags().StringVar(&compressLevel, "compress-level", "default",
+		"the zstd compression level: fastest, default, better or best")
+	Cmd.PersistentFlags().StringVar(&compressDict, "compress-dict", "",
+		"the zstd dictionary file trained on sample traffic (see the dict command), the server has to use the same dictionary")
+	Cmd.PersistentFlags().StringVar(&keyFile, "key-file", "",
+		"the file of the pre-shared key of the client, required by the servers authenticating the clients")
+	Cmd.PersistentFlags().BoolVar(&encryption, "encrypt", false,
+		"encrypt the frames sent to the server and received from it with keys derived from the pre-shared key (requires --key-file). The client exits if the server does not grant the encryption")
+	Cmd.PersistentFlags().StringSliceVar(&quicDatagramGroups, "quic-datagrams", nil,
+		"the loss tolerant groups sent as unreliable QUIC datagrams instead of their stream, as ip[/bits][:port[-port]] ([ip[/bits]][:port[-port]] for IPv6) or * for all the groups (QUIC only). Can be repeated or comma separated")
+	Cmd.PersistentFlags().BoolVar(&tlsEnabled, "tls", false,
+		"connect to the server using tls (implied by the other tls flags)")
+	Cmd.PersistentFlags().StringVar(&tlsCert, "tls-cert", "",
+		"the tls client certificate file (PEM) presented to servers requiring mutual TLS")
+	Cmd.PersistentFlags().StringVar(&tlsKey, "tls-key", "",
+		"the tls private key file (PEM) of the client certificate")
+	Cmd.PersistentFlags().StringVar(&tlsCA, "tls-ca", "",
+		"the CA file (PEM) used to verify the server certificate (default the system roots)")
+	Cmd.PersistentFlags().StringVar(&tlsServerName, "tls-server-name", "",
+		"the server name used to verify the server certificate (default the host of the server address)")
 
-	_ = Cmd.MarkPersistentFlagRequired("interface")
-	_ = Cmd.MarkPersistentFlagRequired("address")
 	_ = Cmd.MarkPersistentFlagRequired("server")
 
 }
 
 func client(cmd *cobra.Command, args []string) error {
-	// connect to server
-	connServer, err := net.Dial("tcp", serverAddress)
+	if reconnectJitter < 0 || reconnectJitter > 1 {
+		return fmt.Errorf("invalid reconnect jitter [%v], expected 0..1", reconnectJitter)
+	}
+	if heartbeatInterval < time.Millisecond || heartbeatTimeout > math.MaxUint32*time.Millisecond {
+		return fmt.Errorf("invalid heartbeat interval [%v] or timeout [%v]", heartbeatInterval, heartbeatTimeout)
+	}
+	if maxDatagramSize < 1 || maxDatagramSize > constants.MaxDatagramSize {
+		return fmt.Errorf("invalid max datagram size [%d], expected 1..%d", maxDatagramSize, constants.MaxDatagramSize)
+	}
+	// the datagrams larger than the batch are sent in their own frame
+	minBatchSize := packet.BatchPacketHeaderLen + packet.BatchEntryHeaderLen + packet.MaxDatagramPacketHeaderLen
+	maxBatchSize := frame.MaxLargeFrameLen - frame.LargeFrameHeaderLen
+	if batchSize < minBatchSize || batchSize > maxBatchSize {
+		return fmt.Errorf("invalid batch size [%d], expected %d..%d", batchSize, minBatchSize, maxBatchSize)
+	}
+	if batchCount < 1 || batchCount > math.MaxUint16 || batchLinger < 0 {
+		return fmt.Errorf("invalid batch count [%d] or linger [%v]", batchCount, batchLinger)
+	}
+	if heartbeatTimeout <= heartbeatInterval {
+		return fmt.Errorf("invalid heartbeat timeout [%v], expected greater than the heartbeat interval [%v]",
+			heartbeatTimeout, heartbeatInterval)
+	}
+	q, err := queue.New(queueSize, queuePolicy)
 	if err != nil {
-		log.Printf("error connecting to server %s: %v", serverAddress, err)
 		return err
 	}
-	defer connServer.Close()
-	log.Printf("connected to server: [%s <-> %s]", connServer.RemoteAddr(), connServer.LocalAddr())
+	if compression {
+		compressOptions, err = compress.NewOptions(compressLevel, compressDict)
+		if err != nil {
+			return err
+		}
+	}
 
-	dataChannel := make(chan *packet.Datagram, 1024)
-	go handleServerConnection(connServer, dataChannel)
+	if clientID == "" {
+		clientID, _ = os.Hostname()
+	}
+	if keyFile != "" {
+		key, err = auth.LoadKey(keyFile)
+		if err != nil {
+			return err
+		}
+	}
+	if encryption && key == nil {
+		return fmt.Errorf("the encryption requires the pre-shared key of the --key-file flag")
+	}
 
-	// listen to udp channel
-	addr, err := net.ResolveUDPAddr("udp4", udpAddress)
+	serverScheme, serverHost, err = transport.ParseAddress(serverAddress)
 	if err != nil {
 		return err
 	}
-
-	var intf *net.Interface = nil
-
-	if udpInterface != "" {
-		intf, err = net.InterfaceByName(udpInterface)
+	quic := serverScheme == transport.SchemeQUIC
+	if encryption && quic {
+		return fmt.Errorf("the QUIC connections are always encrypted with tls, the encryption of the frames is not supported")
+	}
+	for _, s := range quicDatagramGroups {
+		m, err := route.ParseMatch(s)
 		if err != nil {
 			return err
 		}
+		quicDatagrams = append(quicDatagrams, m)
+	}
+	if len(quicDatagrams) > 0 && !quic {
+		return fmt.Errorf("the QUIC datagrams require a quic:// server address")
 	}
 
-	conn, err := net.ListenPacket("udp4", udpAddress)
-	if err != nil {
-		return err
+	if quic || tlsEnabled || tlsCert != "" || tlsKey != "" || tlsCA != "" || tlsServerName != "" {
+		serverName := tlsServerName
+		if serverName == "" {
+			serverName, _, err = net.SplitHostPort(serverHost)
+			if err != nil {
+				return err
+			}
+		}
+		tlsConfig, err = util.ClientTLSConfig(tlsCert, tlsKey, tlsCA, serverName)
+		if err != nil {
+			return err
+		}
 	}
-	defer conn.Close()
 
-	packetConn := ipv4.NewPacketConn(conn)
-	if err := packetConn.JoinGroup(intf, addr); err != nil {
-		return err
+	// the bridge mode is the reverse mode forwarding the joined channels as well
+	if bridge {
+		reverse = true
 	}
-	defer packetConn.LeaveGroup(intf, addr)
 
-	err = packetConn.SetControlMessage(ipv4.FlagTTL|ipv4.FlagSrc|ipv4.FlagDst|ipv4.FlagInterface, true)
-	if err != nil {
-		return err
+	errc := make(chan error, 2)
+	if reverse {
+		if len(udpAddresses) > 0 && !bridge {
+			return fmt.Errorf("the channels can not be joined in reverse mode, use the bridge mode to forward them too")
+		}
+		publishOptions := &publisher.Options{
+			TTL:      mcastTTL,
+			HopLimit: mcastHopLimit,
+			Loopback: mcastLoopback,
+		}
+		if udpInterface != "" {
+			publishOptions.Interface, err = net.InterfaceByName(udpInterface)
+			if err != nil {
+				return err
+			}
+		}
+		publishers = publisher.NewRegistry(publishOptions.Dial, publisherIdleTimeout)
+		defer publishers.Close()
+		published = dedup.New(dedupWindow)
 	}
+	if !reverse || bridge {
+		if len(udpAddresses) == 0 {
+			return fmt.Errorf("required flag \"address\" not set")
+		}
 
-	log.Printf("listening multicast to %s@%s  %v\n", udpAddress, util.StringIfEmpty(udpInterface, "default"), intf)
+		// listen to udp channels
+		groups, err := mcast.ParseGroups(udpAddresses, udpInterface, udpSources, udpExcludedSources)
+		if err != nil {
+			return err
+		}
+		listener, err := mcast.Listen(groups)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
 
-	var buffer []byte
-	// Loop forever reading from the socket
-	for {
+		// every group address is a stream of datagrams, even when joined on many interfaces
+		sequences := make(map[*mcast.Group]*sequence.Counter)
+		streams := make(map[string]*sequence.Counter)
+		for _, g := range listener.Groups() {
+			log.Printf("listening multicast to %s", g)
+			counter, ok := streams[g.Addr.String()]
+			if !ok {
+				counter = &sequence.Counter{}
+				streams[g.Addr.String()] = counter
+			}
+			sequences[g] = counter
+		}
 
-		if buffer == nil {
-			// leave space for the datagram header to avoid reallocation
-			buffer = mcache.Malloc(constants.MaxDatagramSize + packet.DatagramPacketHeaderLen)
+		if statsInterval > 0 {
+			go logStats(listener, q, statsInterval)
 		}
 
-		numBytes, cm, srcAddr, err := packetConn.ReadFrom(buffer[packet.DatagramPacketHeaderLen:])
-		if err != nil {
-			log.Fatal("read from udp failed:", err)
+		// the multicast membership is kept while the server connection is re-established
+		go func() {
+			errc <- listener.Serve(packet.MaxDatagramPacketHeaderLen, maxDatagramSize, func(buffer []byte, numBytes int, g *mcast.Group, src net.Addr, received time.Time) bool {
+				return receive(buffer, numBytes, g, src, received, sequences[g], q)
+			})
+		}()
+	}
+	go func() {
+		errc <- connect(q)
+	}()
+	return <-errc
+}
+
+// logStats periodically logs the counters of the joined channels and of the queue
+func logStats(listener *mcast.Listener, q *queue.Queue, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		log.Printf("stats: %d datagrams queued, %d dropped by the queue, %d larger than %d bytes discarded, %d re-captured discarded",
+			len(q.C), q.Dropped(), listener.Truncated(), maxDatagramSize, atomic.LoadUint64(&looped))
+	}
+}
+
+// receive pushes the datagram received from a multicast channel to the queue.
+// In bridge mode, the datagrams published by the client itself are not sent back to the server.
+func receive(buffer []byte, numBytes int, g *mcast.Group, srcAddr net.Addr, received time.Time, counter *sequence.Counter, q *queue.Queue) bool {
+	payload := buffer[packet.MaxDatagramPacketHeaderLen : packet.MaxDatagramPacketHeaderLen+numBytes]
+	if published.Contains(g.Addr.IP, g.Addr.Port, payload) {
+		n := atomic.AddUint64(&looped, 1)
+		if n&(n-1) == 0 {
+			log.Printf("datagram published by the client re-captured from %s, %d datagrams discarded so far", g, n)
 		}
+		return false
+	}
+	if dumpBytes {
+		log.Printf(strings.Repeat("-", 80))
+		log.Printf("group: %v, addr: %v, numBytes: %d\n", g, srcAddr, numBytes)
+		util.DumpByteSlice(payload)
+	}
+
+	// send the datagram to the server, the buffer is released once sent.
+	// The sequence number is assigned before queueing, so that the datagrams dropped by the queue are detected as lost.
+	d := packet.Datagram{
+		Flags:          packet.DatagramFlagSequence | packet.DatagramFlagTimestamp,
+		Sequence:       counter.Next(),
+		Timestamp:      received.UnixNano(),
+		DatagramLength: uint16(numBytes),
+		UdpIP:          g.Addr.IP,
+		UdpPort:        uint16(g.Addr.Port),
+		DatagramPacket: buffer,
+	}
+	if src, ok := srcAddr.(*net.UDPAddr); ok {
+		d.SrcIP = src.IP
+		d.SrcPort = uint16(src.Port)
+	}
+	q.Push(&d)
+	return true
+}
 
-		if !cm.Dst.IsMulticast() {
-			continue
+// connect keeps the server connection alive, reconnecting with exponential backoff when it is lost.
+// It returns only when the server refuses the client or when the max number of attempts is reached.
+func connect(q *queue.Queue) error {
+	backoff := util.Backoff{
+		Min:    reconnectMin,
+		Max:    reconnectMax,
+		Jitter: reconnectJitter,
+	}
+	attempts := 0
+	for {
+		established, err := session(q)
+		var refused *packet.Error
+		if errors.As(err, &refused) {
+			return fmt.Errorf("server %s refused the connection: %w", serverAddress, err)
 		}
-		if !cm.Dst.Equal(addr.IP) {
-			// unknown group, discard
-			continue
+		if established {
+			backoff.Reset()
+			attempts = 0
 		}
-
-		if dumpBytes {
-			log.Printf(strings.Repeat("-", 80))
-			log.Printf("addr: %v, numBytes: %d\n", srcAddr, numBytes)
-			util.DumpByteSlice(buffer[packet.DatagramPacketHeaderLen : packet.DatagramPacketHeaderLen+numBytes])
+		attempts++
+		if reconnectAttempts > 0 && attempts > reconnectAttempts {
+			return fmt.Errorf("giving up after %d reconnection attempts: %w", reconnectAttempts, err)
 		}
 
-		// send the datagram to the server
-		d := packet.Datagram{
-			DatagramLength: uint16(numBytes),
-			UdpIP:          cm.Dst,
-			UdpPort:        uint16(addr.Port),
-			DatagramPacket: buffer,
+		delay := backoff.Next()
+		log.Printf("connection to server %s lost: %v, reconnecting in %v (%d datagrams queued, %d dropped)",
+			serverAddress, err, delay.Round(time.Millisecond), len(q.C), q.Dropped())
+		time.Sleep(delay)
+	}
+}
+
+// session connects to the server and forwards the queued datagrams until the connection fails.
+// The returned flag tells whether the handshake was completed.
+func session(q *queue.Queue) (bool, error) {
+	// connect to server
+	var connServer net.Conn
+	var err error
+	switch {
+	case serverScheme == transport.SchemeQUIC:
+		connServer, err = transport.Dial(serverHost, tlsConfig, constants.DefaultHandshakeTimeout*time.Second)
+	case tlsConfig != nil:
+		dialer := &net.Dialer{Timeout: constants.DefaultHandshakeTimeout * time.Second}
+		connServer, err = tls.DialWithDialer(dialer, "tcp", serverHost, tlsConfig)
+	default:
+		connServer, err = net.Dial("tcp", serverHost)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer connServer.Close()
+	log.Printf("connected to server: [%s <-> %s]", connServer.RemoteAddr(), connServer.LocalAddr())
+
+	rbuf := bufio.NewReader(connServer)
+	wbuf := bufio.NewWriter(connServer)
+	capabilities := packet.SupportedCapabilities
+	if reverse {
+		capabilities |= packet.CapReverse
+	}
+	if !compression {
+		capabilities &^= packet.CapCompression
+	}
+	if !encryption {
+		capabilities &^= packet.CapEncryption
+	}
+	hs, err := handshake.Client(connServer, rbuf, wbuf, clientID, capabilities, key)
+	if err != nil {
+		return false, err
+	}
+	log.Printf("handshake completed: [id %s, version %d, capabilities %#x, authenticated %v, encrypted %v]",
+		hs.ClientID, hs.Version, hs.Capabilities, hs.Authenticated, hs.Capabilities&packet.CapEncryption != 0)
+	if reverse && hs.Capabilities&packet.CapReverse == 0 {
+		return false, errReverseRefused
+	}
+	if encryption && hs.Capabilities&packet.CapEncryption == 0 {
+		return false, errEncryptionRefused
+	}
+
+	// servers supporting the timestamps always echo the heartbeats, older ones may not flush them
+	var deadTimeout time.Duration
+	if hs.Capabilities&packet.CapTimestamp != 0 {
+		deadTimeout = heartbeatTimeout
+	} else {
+		log.Printf("server does not echo the heartbeats, dead server detection disabled")
+	}
+
+	// the frames are compressed, then encrypted, in both directions
+	frameCodec := hs.FrameCodec()
+	if hs.Capabilities&packet.CapEncryption != 0 {
+		frameCodec, err = encrypt.NewCodec(frameCodec, hs.SessionSecret, true)
+		if err != nil {
+			return true, err
+		}
+	}
+	if hs.Capabilities&packet.CapCompression != 0 {
+		cc, err := compress.NewCodec(frameCodec, compressOptions)
+		if err != nil {
+			return true, err
 		}
-		dataChannel <- &d
-		buffer = nil
+		defer cc.Close()
+		defer func() {
+			sent, received := cc.Stats()
+			log.Printf("compression: sent %s, received %s", sent, received)
+		}()
+		frameCodec = cc
+	} else if compression {
+		log.Printf("server does not support the compression")
 	}
+
+	// round trip time measured with the heartbeats, in nanoseconds
+	var rtt int64
+	done := make(chan struct{})
+	errc := make(chan error, 2)
+	go func() {
+		errc <- handleServerResponse(connServer, rbuf, frameCodec, &rtt, deadTimeout)
+	}()
+	go func() {
+		qc, _ := connServer.(*transport.Conn)
+		errc <- handleServerConnection(wbuf, qc, frameCodec, hs.Capabilities, q.C, done, &rtt)
+	}()
+
+	// the first failure stops both directions
+	err = <-errc
+	close(done)
+	connServer.Close()
+	<-errc
+	return true, err
 }
 
-func handleServerConnection(conn net.Conn, in <-chan *packet.Datagram) {
-	timer := time.NewTicker(time.Second * constants.DefaultHeartbeatTimeout / 2)
+// handleServerConnection sends the heartbeats and the datagrams to the server. Over QUIC (qc not nil) the datagrams
+// are sent on the streams of their groups, or as QUIC datagrams.
+func handleServerConnection(wbuf *bufio.Writer, qc *transport.Conn, frameCodec frame.StreamFrameCodec, capabilities uint32, in <-chan *packet.Datagram, done <-chan struct{}, rtt *int64) error {
+	timer := time.NewTicker(heartbeatInterval)
+	defer timer.Stop()
+
+	sendHeartbeat := func() error {
+		// the server echoes the timestamp back to measure the round trip time, and the clock offset of the client,
+		// and adopts the heartbeat timeout of the client
+		heartbeat := packet.Heartbeat{}
+		if capabilities&packet.CapTimestamp != 0 {
+			heartbeat.Timestamp = time.Now().UnixNano()
+			heartbeat.RTT = atomic.LoadInt64(rtt)
+			heartbeat.Interval = uint32(heartbeatInterval / time.Millisecond)
+			heartbeat.Timeout = uint32(heartbeatTimeout / time.Millisecond)
+		}
+		err := packet.WriteFrame(frameCodec, wbuf, &heartbeat)
+		if err != nil {
+			return fmt.Errorf("write error while sending heartbeat: %w", err)
+		}
+		return nil
+	}
 
-	go handleServerResponse(conn)
+	// the first heartbeat announces the heartbeat timeout to the server before its own deadline expires
+	if capabilities&packet.CapTimestamp != 0 {
+		if err := sendHeartbeat(); err != nil {
+			return err
+		}
+	}
 
-	frameCodec := frame.NewFrameCodec()
-	wbuf := bufio.NewWriter(conn)
+	// datagrams are packed into batches if supported by the server
+	var size int
+	var linger <-chan time.Time
+	if capabilities&packet.CapBatch != 0 && batchCount > 1 {
+		// older servers receive the batches in the small frames
+		size = batchSize
+		if size > frameCodec.MaxPayloadLen() {
+			size = frameCodec.MaxPayloadLen()
+		}
+	}
+	ls := newLanes(frameCodec, wbuf, qc, size)
+	defer ls.release()
 
-	heartbeatBuffer := make([]byte, packet.HeartbeatPacketHeaderLen)
-	p := packet.Heartbeat{}
-	p.Encode(heartbeatBuffer)
+	var unsupported, oversized uint64
 
 	for {
 		select {
+		case <-done:
+			return nil
 		case <-timer.C:
-			err := frameCodec.Encode(wbuf, heartbeatBuffer)
-			if err != nil {
-				log.Fatalf("write error while sending heartbeat: %v", err)
-				return
+			if err := sendHeartbeat(); err != nil {
+				return err
 			}
-			err = wbuf.Flush()
-			if err != nil {
-				log.Fatalf("write error while flushing: %v", err)
-				return
+		case <-linger:
+			linger = nil
+			if err := ls.flush(); err != nil {
+				return fmt.Errorf("write error while sending batch: %w", err)
 			}
 		case data := <-in:
-			// unwrap buffer from packet to avoid encoding it (is already ready to be sent except for the header)
-			buffer := data.DatagramPacket
-			data.DatagramPacket = nil
-			data.Encode(buffer)
-			err := frameCodec.Encode(wbuf, buffer[:packet.DatagramPacketHeaderLen+data.DatagramLength])
-			mcache.Free(buffer)
-			if err != nil {
-				log.Fatalf("write error while sending datagram: %v", err)
-				return
+			// optional fields are sent only if supported by the server
+			if !data.Negotiate(capabilities) {
+				// the server can not handle IPv6 addresses
+				mcache.Free(data.DatagramPacket)
+				unsupported++
+				if unsupported&(unsupported-1) == 0 {
+					log.Printf("server does not support IPv6, %d datagrams dropped so far", unsupported)
+				}
+				continue
 			}
-			err = wbuf.Flush()
-			if err != nil {
-				log.Fatalf("write error while flushing: %v", err)
-				return
+			if data.Length() > frameCodec.MaxPayloadLen() {
+				// the server does not support the large frames
+				mcache.Free(data.DatagramPacket)
+				oversized++
+				if oversized&(oversized-1) == 0 {
+					log.Printf("datagram of %d bytes too large for the server frames, %d datagrams dropped so far",
+						data.DatagramLength, oversized)
+				}
+				continue
+			}
+			// the header is encoded in the space reserved in front of the datagram, the buffer is released once sent.
+			// The batches are flushed when full, when the linger expires, or without linger as soon as the queue is empty
+			if err := ls.send(data); err != nil {
+				return fmt.Errorf("write error while sending datagram: %w", err)
+			}
+			switch {
+			case !ls.hasPending():
+				linger = nil
+			case batchLinger == 0 && len(in) == 0:
+				if err := ls.flush(); err != nil {
+					return fmt.Errorf("write error while sending batch: %w", err)
+				}
+			case batchLinger > 0 && linger == nil:
+				linger = time.After(batchLinger)
 			}
 		}
 	}
 }
 
-func handleServerResponse(conn net.Conn) {
-	frameCodec := frame.NewFrameCodec()
-	rbuf := bufio.NewReader(conn)
+// handleServerResponse reads the packets sent by the server. Without any packet for the dead timeout (if not zero),
+// the server is considered dead, and the connection is closed instead of hanging on a half-open connection.
+func handleServerResponse(conn net.Conn, rbuf *bufio.Reader, frameCodec frame.StreamFrameCodec, rtt *int64, deadTimeout time.Duration) error {
 	for {
+		if deadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(deadTimeout))
+		}
 		framePayload, err := frameCodec.Decode(rbuf)
 		if err != nil {
-			log.Fatalf("read error: %v", err)
-			return
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return fmt.Errorf("no packet received from the server for %v", deadTimeout)
+			}
+			return fmt.Errorf("read error: %w", err)
 		}
 		p, err := packet.Decode(framePayload)
 		if err != nil {
-			log.Fatalf("packet decode error: %v", err)
-			return
+			return fmt.Errorf("packet decode error: %w", err)
 		}
 		switch p.(type) {
 		case *packet.Heartbeat:
-			log.Printf("heartbeat received")
+			ts := p.(*packet.Heartbeat).Timestamp
+			if ts == 0 {
+				log.Printf("heartbeat received")
+				break
+			}
+			d := time.Now().UnixNano() - ts
+			atomic.StoreInt64(rtt, d)
+			log.Printf("heartbeat received (rtt %v)", time.Duration(d))
+		case *packet.Datagram:
+			if !reverse {
+				return fmt.Errorf("unexpected datagram received")
+			}
+			republish(p.(*packet.Datagram))
+		case *packet.Error:
+			return p.(*packet.Error)
 		default:
-			log.Fatalf("unknown packet received: %v", p)
+			return fmt.Errorf("unknown packet received: %v", p)
 		}
 		mcache.Free(framePayload)
 	}
 }
+
+// republish publishes the datagram streamed by the server on the same channel on the client side.
+// Publishing errors are accounted by the publisher registry and do not break the connection.
+func republish(d *packet.Datagram) {
+	dst := &net.UDPAddr{IP: d.UdpIP, Port: int(d.UdpPort)}
+	// remembered before sending, the looped back copy may be received before the write returns
+	published.Add(dst.IP, dst.Port, d.DatagramPacket)
+	if err := publishers.Write(serverAddress, dst, d.DatagramPacket); err != nil {
+		return
+	}
+
+	if dumpBytes {
+		log.Printf(strings.Repeat("-", 80))
+		log.Printf("src: %v, origin: %v, addr: %v, numBytes: %d\n", serverAddress, d.Source(), dst, len(d.DatagramPacket))
+		util.DumpByteSlice(d.DatagramPacket)
+	}
+}
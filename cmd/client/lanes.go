@@ -0,0 +1,162 @@
+package client
+
+import (
+	"bufio"
+	"github.com/bytedance/gopkg/lang/mcache"
+	"github.com/mgeri/udptunneler/pkg/frame"
+	"github.com/mgeri/udptunneler/pkg/packet"
+	"github.com/mgeri/udptunneler/pkg/route"
+	"github.com/mgeri/udptunneler/pkg/transport"
+	"log"
+	"net"
+)
+
+// lane is an outbound stream of frames, with the batch of its pending datagrams
+type lane struct {
+	wbuf    *bufio.Writer
+	batch   *packet.BatchWriter // nil without batches
+	pending bool                // listed in the lanes to flush
+}
+
+// group identifies the multicast group of a datagram without allocating
+type group struct {
+	ip   [net.IPv6len]byte
+	port uint16
+}
+
+// lanes routes the datagrams to the server. Over tcp every datagram is sent on the connection. Over QUIC every group
+// has its own stream, so that a lost packet stalls only the datagrams of its group, and the datagrams of the loss
+// tolerant groups are sent as QUIC datagrams, falling back to the stream of their group when too large.
+type lanes struct {
+	frameCodec frame.StreamFrameCodec
+	batchSize  int // 0 without batches
+	control    *lane
+	conn       *transport.Conn // nil over tcp
+	groups     map[group]*lane
+	pending    []*lane
+	refused    uint64 // datagrams not sent as QUIC datagrams
+	exhausted  bool   // the server does not allow more streams
+}
+
+func newLanes(frameCodec frame.StreamFrameCodec, wbuf *bufio.Writer, conn *transport.Conn, batchSize int) *lanes {
+	ls := &lanes{
+		frameCodec: frameCodec,
+		batchSize:  batchSize,
+		conn:       conn,
+		groups:     make(map[group]*lane),
+	}
+	ls.control = ls.newLane(wbuf)
+	return ls
+}
+
+func (ls *lanes) newLane(wbuf *bufio.Writer) *lane {
+	l := &lane{wbuf: wbuf}
+	if ls.batchSize > 0 {
+		l.batch = packet.NewBatchWriter(ls.frameCodec, wbuf, ls.batchSize, batchCount)
+	}
+	return l
+}
+
+// send sends the datagram, or adds it to the batch of its lane. The buffer of the datagram is released.
+func (ls *lanes) send(d *packet.Datagram) error {
+	if ls.conn != nil && matchesAny(quicDatagrams, d) && ls.sendDatagram(d) {
+		return nil
+	}
+	l := ls.route(d)
+	if l.batch == nil {
+		return packet.WriteDatagram(ls.frameCodec, l.wbuf, d)
+	}
+	err := l.batch.Add(d)
+	if l.batch.Len() > 0 && !l.pending {
+		l.pending = true
+		ls.pending = append(ls.pending, l)
+	}
+	return err
+}
+
+// sendDatagram sends the datagram as a QUIC datagram, without frame. When refused (e.g. too large) the datagram is
+// left untouched to be sent on a stream.
+func (ls *lanes) sendDatagram(d *packet.Datagram) bool {
+	buffer := d.DatagramPacket
+	offset := packet.MaxDatagramPacketHeaderLen - d.HeaderLength()
+	d.DatagramPacket = nil
+	err := d.Encode(buffer[offset:])
+	if err == nil {
+		err = ls.conn.SendDatagram(buffer[offset : offset+d.Length()])
+	}
+	if err != nil {
+		d.DatagramPacket = buffer
+		ls.refused++
+		if ls.refused&(ls.refused-1) == 0 {
+			log.Printf("datagram of %d bytes not sent as QUIC datagram (%s), sent on the stream of its group, %d datagrams so far",
+				d.DatagramLength, err, ls.refused)
+		}
+		return false
+	}
+	mcache.Free(buffer)
+	return true
+}
+
+// route returns the lane of the group of the datagram, opening its stream on first use
+func (ls *lanes) route(d *packet.Datagram) *lane {
+	if ls.conn == nil || ls.exhausted {
+		return ls.control
+	}
+	var g group
+	copy(g.ip[:], d.UdpIP.To16())
+	g.port = d.UdpPort
+	if l, ok := ls.groups[g]; ok {
+		return l
+	}
+	s, err := ls.conn.OpenStream()
+	if err != nil {
+		// the groups without stream share the control stream
+		log.Printf("stream of group %s not opened, the next groups are sent on the control stream: %s",
+			&net.UDPAddr{IP: d.UdpIP, Port: int(d.UdpPort)}, err)
+		ls.exhausted = true
+		return ls.control
+	}
+	l := ls.newLane(bufio.NewWriter(s))
+	ls.groups[g] = l
+	return l
+}
+
+// hasPending tells whether some batches are waiting to be flushed
+func (ls *lanes) hasPending() bool {
+	return len(ls.pending) > 0
+}
+
+// flush writes the pending batches
+func (ls *lanes) flush() error {
+	for _, l := range ls.pending {
+		l.pending = false
+		if err := l.batch.Flush(); err != nil {
+			ls.pending = ls.pending[:0]
+			return err
+		}
+	}
+	ls.pending = ls.pending[:0]
+	return nil
+}
+
+// release releases the batch buffers, discarding the pending datagrams
+func (ls *lanes) release() {
+	if ls.control.batch != nil {
+		ls.control.batch.Release()
+	}
+	for _, l := range ls.groups {
+		if l.batch != nil {
+			l.batch.Release()
+		}
+	}
+}
+
+// matchesAny tells whether the group of the datagram is matched by any of the matches
+func matchesAny(matches []*route.Match, d *packet.Datagram) bool {
+	for _, m := range matches {
+		if m.Matches(d.UdpIP, int(d.UdpPort)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package dict
+
+import (
+	"fmt"
+	"github.com/klauspost/compress/dict"
+	constants "github.com/mgeri/udptunneler/pkg"
+	"github.com/mgeri/udptunneler/pkg/mcast"
+	"github.com/spf13/cobra"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	udpInterface       string
+	udpAddresses       []string
+	udpSources         []string
+	udpExcludedSources []string
+	maxDatagramSize    int
+	samples            int
+	duration           time.Duration
+	maxDictSize        int
+	output             string
+
+	Cmd = &cobra.Command{
+		Use:   "dict",
+		Short: "Train a compression dictionary on sample UDP multicast traffic",
+		Long:  ``,
+		RunE:  train,
+	}
+)
+
+func init() {
+
+	Cmd.PersistentFlags().StringVarP(&udpInterface, "interface", "i", "",
+		"the network interface used to join the multicast channels without an explicit interface")
+	Cmd.PersistentFlags().StringSliceVarP(&udpAddresses, "address", "a", nil,
+		"the udp destination IP and port of the channel we want to join, as ip:port[@interface]. Can be repeated or comma separated to join many channels")
+	Cmd.PersistentFlags().StringSliceVar(&udpSources, "source", nil,
+		"the source IP of a source-specific multicast (S,G) channel. Can be repeated or comma separated, applied to all the channels")
+	Cmd.PersistentFlags().StringSliceVar(&udpExcludedSources, "exclude-source", nil,
+		"the source IP whose datagrams are blocked on any-source channels. Can be repeated or comma separated, applied to all the channels")
+	Cmd.PersistentFlags().IntVar(&maxDatagramSize, "max-datagram-size", constants.DefaultDatagramSize,
+		"the max size of the datagrams received from the multicast channels, larger datagrams are discarded (max 65507)")
+	Cmd.PersistentFlags().IntVarP(&samples, "samples", "n", 10000,
+		"the number of datagrams sampled")
+	Cmd.PersistentFlags().DurationVar(&duration, "duration", time.Minute,
+		"the max time spent sampling the datagrams")
+	Cmd.PersistentFlags().IntVar(&maxDictSize, "max-size", 64*1024,
+		"the max size of the dictionary")
+	Cmd.PersistentFlags().StringVarP(&output, "output", "o", "",
+		"the dictionary file written")
+
+	_ = Cmd.MarkPersistentFlagRequired("address")
+	_ = Cmd.MarkPersistentFlagRequired("output")
+
+}
+
+func train(cmd *cobra.Command, args []string) error {
+	if maxDatagramSize < 1 || maxDatagramSize > constants.MaxDatagramSize {
+		return fmt.Errorf("invalid max datagram size [%d], expected 1..%d", maxDatagramSize, constants.MaxDatagramSize)
+	}
+	if samples < 1 || maxDictSize < 1024 {
+		return fmt.Errorf("invalid samples [%d] or max size [%d]", samples, maxDictSize)
+	}
+
+	// listen to udp channels
+	groups, err := mcast.ParseGroups(udpAddresses, udpInterface, udpSources, udpExcludedSources)
+	if err != nil {
+		return err
+	}
+	listener, err := mcast.Listen(groups)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range listener.Groups() {
+		log.Printf("listening multicast to %s", g)
+	}
+
+	// the sockets are read concurrently
+	var mu sync.Mutex
+	var input [][]byte
+	done := make(chan struct{})
+	go func() {
+		listener.Serve(0, maxDatagramSize, func(buffer []byte, numBytes int, _ *mcast.Group, _ net.Addr, _ time.Time) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			if len(input) == samples {
+				return false
+			}
+			input = append(input, append([]byte(nil), buffer[:numBytes]...))
+			if len(input) == samples {
+				close(done)
+			}
+			return false
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(duration):
+	}
+	listener.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	log.Printf("training the dictionary on %d datagrams", len(input))
+	if len(input) == 0 {
+		return fmt.Errorf("no datagram received in %v", duration)
+	}
+	b, err := dict.BuildZstdDict(input, dict.Options{
+		MaxDictSize: maxDictSize,
+		HashBytes:   6,
+	})
+	if err != nil {
+		return fmt.Errorf("error training the dictionary: %w", err)
+	}
+	if err = os.WriteFile(output, b, 0644); err != nil {
+		return err
+	}
+	log.Printf("dictionary of %d bytes written to %s", len(b), output)
+	return nil
+}
@@ -1,19 +1,23 @@
 package dump
 
 import (
+	"fmt"
 	constants "github.com/mgeri/udptunneler/pkg"
+	"github.com/mgeri/udptunneler/pkg/mcast"
 	"github.com/mgeri/udptunneler/pkg/util"
 	"github.com/spf13/cobra"
-	"golang.org/x/net/ipv4"
 	"log"
 	"net"
 	"strings"
+	"time"
 )
 
 var (
-	udpInterface  string
-	udpAddress    string
-	serverAddress string
+	udpInterface       string
+	udpAddresses       []string
+	udpSources         []string
+	udpExcludedSources []string
+	maxDatagramSize    int
 
 	Cmd = &cobra.Command{
 		Use:   "dump",
@@ -26,71 +30,47 @@ var (
 func init() {
 
 	Cmd.PersistentFlags().StringVarP(&udpInterface, "interface", "i", "",
-		"the network interface used to join the provided multicast channel provided")
-	Cmd.PersistentFlags().StringVarP(&udpAddress, "address", "a", "",
-		"the udp destination IP and port of the channel we want to join")
+		"the network interface used to join the multicast channels without an explicit interface")
+	Cmd.PersistentFlags().StringSliceVarP(&udpAddresses, "address", "a", nil,
+		"the udp destination IP and port of the channel we want to join, as ip:port[@interface]. Can be repeated or comma separated to join many channels")
+	Cmd.PersistentFlags().StringSliceVar(&udpSources, "source", nil,
+		"the source IP of a source-specific multicast (S,G) channel. Can be repeated or comma separated, applied to all the channels")
+	Cmd.PersistentFlags().StringSliceVar(&udpExcludedSources, "exclude-source", nil,
+		"the source IP whose datagrams are blocked on any-source channels. Can be repeated or comma separated, applied to all the channels")
+	Cmd.PersistentFlags().IntVar(&maxDatagramSize, "max-datagram-size", constants.DefaultDatagramSize,
+		"the max size of the datagrams received from the multicast channels, larger datagrams are discarded (max 65507)")
 
-	_ = Cmd.MarkPersistentFlagRequired("interface")
 	_ = Cmd.MarkPersistentFlagRequired("address")
 
 }
 
 func dump(cmd *cobra.Command, args []string) error {
-
-	// listen to udp channel
-	addr, err := net.ResolveUDPAddr("udp4", udpAddress)
-	if err != nil {
-		return err
-	}
-
-	var intf *net.Interface = nil
-
-	if udpInterface != "" {
-		intf, err = net.InterfaceByName(udpInterface)
-		if err != nil {
-			return err
-		}
+	if maxDatagramSize < 1 || maxDatagramSize > constants.MaxDatagramSize {
+		return fmt.Errorf("invalid max datagram size [%d], expected 1..%d", maxDatagramSize, constants.MaxDatagramSize)
 	}
 
-	conn, err := net.ListenPacket("udp4", udpAddress)
+	// listen to udp channels
+	groups, err := mcast.ParseGroups(udpAddresses, udpInterface, udpSources, udpExcludedSources)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-
-	packetConn := ipv4.NewPacketConn(conn)
-	if err := packetConn.JoinGroup(intf, addr); err != nil {
-		return err
-	}
-	defer packetConn.LeaveGroup(intf, addr)
-
-	err = packetConn.SetControlMessage(ipv4.FlagTTL|ipv4.FlagSrc|ipv4.FlagDst|ipv4.FlagInterface, true)
+	listener, err := mcast.Listen(groups)
 	if err != nil {
 		return err
 	}
+	defer listener.Close()
 
-	log.Printf("listening multicast to %s@%s  %v\n", udpAddress, util.StringIfEmpty(udpInterface, "default"), intf)
-
-	var buffer = make([]byte, constants.MaxDatagramSize)
-
-	// Loop forever reading from the socket
-	for {
-
-		numBytes, cm, srcAddr, err := packetConn.ReadFrom(buffer)
-		if err != nil {
-			log.Fatal("read from udp failed:", err)
-		}
-
-		if !cm.Dst.IsMulticast() {
-			continue
-		}
-		if !cm.Dst.Equal(addr.IP) {
-			// unknown group, discard
-			continue
-		}
+	for _, g := range listener.Groups() {
+		log.Printf("listening multicast to %s", g)
+	}
 
+	// Loop forever reading from the sockets
+	err = listener.Serve(0, maxDatagramSize, func(buffer []byte, numBytes int, g *mcast.Group, srcAddr net.Addr, _ time.Time) bool {
 		log.Printf(strings.Repeat("-", 80))
-		log.Printf("addr: %v, numBytes: %d\n", srcAddr, numBytes)
+		log.Printf("group: %v, addr: %v, numBytes: %d\n", g, srcAddr, numBytes)
 		util.DumpByteSlice(buffer[:numBytes])
-	}
+		return false
+	})
+	log.Printf("%d datagrams larger than %d bytes discarded", listener.Truncated(), maxDatagramSize)
+	return err
 }
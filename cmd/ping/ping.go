@@ -28,12 +28,12 @@ func init() {
 }
 
 func ping(cmd *cobra.Command, args []string) error {
-	addr, err := net.ResolveUDPAddr("udp4", udpAddress)
+	addr, err := net.ResolveUDPAddr("udp", udpAddress)
 	if err != nil {
 		return err
 	}
 
-	conn, err := net.DialUDP("udp4", nil, addr)
+	conn, err := net.DialUDP("udp", nil, addr)
 	if err != nil {
 		return err
 	}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"github.com/mgeri/udptunneler/cmd/client"
+	"github.com/mgeri/udptunneler/cmd/dict"
 	"github.com/mgeri/udptunneler/cmd/dump"
 	"github.com/mgeri/udptunneler/cmd/ping"
 	"github.com/mgeri/udptunneler/cmd/server"
@@ -33,6 +34,7 @@ func init() {
 	udptunneler.AddCommand(client.Cmd)
 	udptunneler.AddCommand(ping.Cmd)
 	udptunneler.AddCommand(dump.Cmd)
+	udptunneler.AddCommand(dict.Cmd)
 }
 
 func initConfig() {
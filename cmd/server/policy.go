@@ -0,0 +1,56 @@
+package server
+
+import (
+	"github.com/mgeri/udptunneler/pkg/packet"
+	"github.com/mgeri/udptunneler/pkg/policy"
+	"log"
+	"net"
+	"time"
+)
+
+// authorization holds the policy rule of a client and its rate limiters
+type authorization struct {
+	rule         *policy.Rule
+	datagrams    *policy.Limiter
+	bytes        *policy.Limiter
+	unauthorized uint64 // datagrams refused by the groups of the rule
+	limited      uint64 // datagrams refused by the rate limits of the rule
+}
+
+func newAuthorization(rule *policy.Rule) *authorization {
+	return &authorization{
+		rule:      rule,
+		datagrams: policy.NewLimiter(rule.Rate),
+		bytes:     policy.NewLimiter(rule.Bytes),
+	}
+}
+
+// authorize checks the destination of the datagram and the rate limits against the policy rule of the client.
+// Every client is authorized when no policy is configured.
+func (p *peer) authorize(d *packet.Datagram, received time.Time) bool {
+	a := p.authorization
+	if a == nil {
+		return true
+	}
+	if !a.rule.Allows(d.UdpIP, int(d.UdpPort)) {
+		a.unauthorized++
+		if a.unauthorized&(a.unauthorized-1) == 0 {
+			log.Printf("handleConn[%s] datagram to %s not authorized by policy [%s], %d datagrams refused so far",
+				p, &net.UDPAddr{IP: d.UdpIP, Port: int(d.UdpPort)}, a.rule, a.unauthorized)
+		}
+		return false
+	}
+	// the tokens are consumed only when both limits allow the datagram
+	size := float64(len(d.DatagramPacket))
+	if !a.bytes.Available(size, received) || !a.datagrams.Available(1, received) {
+		a.limited++
+		if a.limited&(a.limited-1) == 0 {
+			log.Printf("handleConn[%s] datagram to %s over the rate limits of policy [%s], %d datagrams refused so far",
+				p, &net.UDPAddr{IP: d.UdpIP, Port: int(d.UdpPort)}, a.rule, a.limited)
+		}
+		return false
+	}
+	a.bytes.Take(size)
+	a.datagrams.Take(1)
+	return true
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"github.com/mgeri/udptunneler/pkg/packet"
+	"github.com/mgeri/udptunneler/pkg/route"
+	"github.com/mgeri/udptunneler/pkg/util"
+	"log"
+	"net"
+	"strings"
+)
+
+const (
+	UnmatchedForward = "forward"
+	UnmatchedDrop    = "drop"
+)
+
+// loadRoutes builds the routing table from the routes file and the route flags. The --address flag, when provided,
+// is the default route.
+func loadRoutes() (*route.Table, error) {
+	table := &route.Table{}
+	if routesFile != "" {
+		rules, err := route.LoadFile(routesFile)
+		if err != nil {
+			return nil, err
+		}
+		table.Add(rules...)
+	}
+	rules, err := route.ParseRules(routeRules)
+	if err != nil {
+		return nil, err
+	}
+	table.Add(rules...)
+
+	if udpAddress != "" {
+		addr, err := net.ResolveUDPAddr("udp", udpAddress)
+		if err != nil {
+			return nil, err
+		}
+		table.Add(&route.Rule{
+			Match:   route.Match{PortMin: 0, PortMax: 0xffff},
+			Targets: []*route.Target{{Addr: addr}},
+		})
+	}
+
+	switch unmatched {
+	case UnmatchedForward, UnmatchedDrop:
+	default:
+		return nil, fmt.Errorf("invalid unmatched policy [%s], expected %s or %s", unmatched, UnmatchedForward, UnmatchedDrop)
+	}
+	return table, nil
+}
+
+// destinations returns the addresses where the datagram is published, none when it has to be dropped
+func destinations(d *packet.Datagram) []*net.UDPAddr {
+	port := int(d.UdpPort)
+	r := routes.Lookup(d.UdpIP, port)
+	if r == nil {
+		if unmatched == UnmatchedDrop {
+			return nil
+		}
+		return []*net.UDPAddr{{IP: d.UdpIP, Port: port}}
+	}
+	return r.Destinations(port)
+}
+
+// publish sends the datagram to a single destination, through the raw socket when enabled. The destinations with the
+// interface of a route (zone) are left to the regular publisher, the raw socket publishes on a single interface.
+func publish(pr *peer, d *packet.Datagram, dst *net.UDPAddr) error {
+	// remembered before sending, the looped back copy may be received before the write returns
+	published.Add(dst.IP, dst.Port, d.DatagramPacket)
+
+	if rawConn != nil && dst.Zone == "" {
+		sent, err := publishRaw(d, dst)
+		if sent || err != nil {
+			publishers.Account(pr.key(), dst, err)
+			return err
+		}
+	}
+
+	err := publishers.Write(pr.key(), dst, d.DatagramPacket)
+	if err != nil {
+		return err
+	}
+
+	if dumpBytes {
+		log.Printf(strings.Repeat("-", 80))
+		log.Printf("src: %v, origin: %v, addr: %v, numBytes: %d\n",
+			pr, originString(d), dst, len(d.DatagramPacket))
+		util.DumpByteSlice(d.DatagramPacket)
+	}
+	return nil
+}
+
+// publishRaw publishes the datagram with its original source address through the raw socket.
+// Datagrams without source address, or not IPv4, are not sent and left to the regular publisher.
+func publishRaw(d *packet.Datagram, dst *net.UDPAddr) (bool, error) {
+	src := d.Source()
+	if src == nil || src.IP.To4() == nil {
+		return false, nil
+	}
+	if dst.IP.To4() == nil {
+		return false, nil
+	}
+	err := rawConn.WriteTo(d.DatagramPacket, src, dst)
+	if err != nil {
+		return false, err
+	}
+
+	if dumpBytes {
+		log.Printf(strings.Repeat("-", 80))
+		log.Printf("src: raw, origin: %v, addr: %v, numBytes: %d\n", src, dst, len(d.DatagramPacket))
+		util.DumpByteSlice(d.DatagramPacket)
+	}
+	return true, nil
+}
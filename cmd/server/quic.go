@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/bytedance/gopkg/lang/mcache"
+	constants "github.com/mgeri/udptunneler/pkg"
+	"github.com/mgeri/udptunneler/pkg/frame"
+	"github.com/mgeri/udptunneler/pkg/packet"
+	"github.com/mgeri/udptunneler/pkg/transport"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// serveQUIC accepts the QUIC connections, handled as the tcp ones once their control stream is opened
+func serveQUIC(l *transport.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Println("quic accept error:", err)
+			return
+		}
+		go func() {
+			if err := c.AcceptControl(constants.DefaultHandshakeTimeout * time.Second); err != nil {
+				log.Printf("handleConn[%s] quic control stream error: %s", c.RemoteAddr(), err)
+				return
+			}
+			handleConn(c)
+		}()
+	}
+}
+
+// receiveQUIC handles the datagrams the QUIC client sends out of the control stream: on a stream per group, and as
+// QUIC datagrams for the loss tolerant groups. The receivers stop when the connection is closed.
+func receiveQUIC(pr *peer, c *transport.Conn, frameCodec frame.StreamFrameCodec, wg *sync.WaitGroup) {
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			s, err := c.AcceptStream()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				readStream(pr, c, s, frameCodec)
+			}()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			b, err := c.ReceiveDatagram()
+			if err != nil {
+				return
+			}
+			// a QUIC datagram carries a single packet, without frame
+			if err = handleData(pr, b, time.Now()); err != nil {
+				log.Printf("handleConn[%s] quic datagram handle error: %s", pr, err)
+			}
+		}
+	}()
+}
+
+// readStream handles the frames of a stream opened by the client, until the stream or the connection is closed
+func readStream(pr *peer, c *transport.Conn, s io.Reader, frameCodec frame.StreamFrameCodec) {
+	rbuf := bufio.NewReader(s)
+	for {
+		framePayload, err := frameCodec.Decode(rbuf)
+		if err != nil {
+			select {
+			case <-c.Done():
+			default:
+				if err != io.EOF {
+					log.Printf("handleConn[%s] stream frame decode error: %s", pr, err)
+				}
+			}
+			return
+		}
+		err = handleData(pr, framePayload, time.Now())
+		mcache.Free(framePayload)
+		if err != nil {
+			log.Printf("handleConn[%s] stream packet handle error: %s", pr, err)
+		}
+	}
+}
+
+// handleData handles a packet received out of the control stream, where only the datagrams are expected
+func handleData(pr *peer, payload []byte, received time.Time) error {
+	p, err := packet.Decode(payload)
+	if err != nil {
+		return err
+	}
+	switch p := p.(type) {
+	case *packet.Datagram:
+		return handleDatagrams(pr, received, p)
+	case *packet.Batch:
+		return handleDatagrams(pr, received, p.Datagrams...)
+	default:
+		return fmt.Errorf("unexpected packet type [%d] out of the control stream", payload[0])
+	}
+}
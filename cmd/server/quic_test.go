@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/bytedance/gopkg/lang/mcache"
+	"github.com/mgeri/udptunneler/pkg/auth"
+	"github.com/mgeri/udptunneler/pkg/compress"
+	"github.com/mgeri/udptunneler/pkg/handshake"
+	"github.com/mgeri/udptunneler/pkg/packet"
+	"github.com/mgeri/udptunneler/pkg/policy"
+	"github.com/mgeri/udptunneler/pkg/publisher"
+	"github.com/mgeri/udptunneler/pkg/route"
+	"github.com/mgeri/udptunneler/pkg/transport"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID = "client-1"
+	testKey      = "0123456789abcdef0123456789abcdef"
+)
+
+// startQUIC starts a QUIC server authenticating the clients with the test key, and with the policy (nil for none)
+func startQUIC(t *testing.T, p *policy.Policy) string {
+	t.Helper()
+	keys = auth.Keys{testClientID: []byte(testKey)}
+	policies = p
+	routes = &route.Table{}
+	unmatched = UnmatchedForward
+	heartbeatTimeout = 10 * time.Second
+	var err error
+	if compressOptions, err = compress.NewOptions("default", ""); err != nil {
+		t.Fatal(err)
+	}
+	publishers = publisher.NewRegistry((&publisher.Options{TTL: 1, HopLimit: 1, Loopback: true}).Dial, time.Minute)
+	clients = &peers{m: make(map[*peer]struct{})}
+	subscribers = newStreams()
+
+	l, err := transport.Listen("127.0.0.1:0", testTLSConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveQUIC(l)
+	t.Cleanup(func() {
+		l.Close()
+		publishers.Close()
+		keys = nil
+		policies = nil
+	})
+	return l.Addr().String()
+}
+
+// testTLSConfig returns the tls config of a self-signed certificate
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "udptunneler"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// dialQUIC connects and authenticates a client requesting every supported capability
+func dialQUIC(t *testing.T, address string) (*transport.Conn, *handshake.Result, error) {
+	t.Helper()
+	conn, err := transport.Dial(address, &tls.Config{InsecureSkipVerify: true}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	hs, err := handshake.Client(conn, bufio.NewReader(conn), bufio.NewWriter(conn), testClientID,
+		packet.SupportedCapabilities, []byte(testKey))
+	return conn, hs, err
+}
+
+// listenGroups opens the local udp sockets standing for the groups
+func listenGroups(t *testing.T, n int) []*net.UDPConn {
+	t.Helper()
+	groups := make([]*net.UDPConn, n)
+	for i := range groups {
+		c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadBuffer(1 << 20)
+		t.Cleanup(func() { c.Close() })
+		groups[i] = c
+	}
+	return groups
+}
+
+// sendStream sends the datagrams of a group on a stream of its own
+func sendStream(conn *transport.Conn, hs *handshake.Result, group *net.UDPAddr, count int) error {
+	s, err := conn.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	frameCodec := hs.FrameCodec()
+	wbuf := bufio.NewWriter(s)
+	for i := 0; i < count; i++ {
+		payload := []byte(fmt.Sprintf("%s #%d", group, i))
+		buffer := mcache.Malloc(packet.MaxDatagramPacketHeaderLen + len(payload))
+		copy(buffer[packet.MaxDatagramPacketHeaderLen:], payload)
+		d := &packet.Datagram{
+			Type:           packet.TypeDatagram,
+			DatagramLength: uint16(len(payload)),
+			UdpIP:          group.IP,
+			UdpPort:        uint16(group.Port),
+			DatagramPacket: buffer,
+		}
+		if err = packet.WriteDatagram(frameCodec, wbuf, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receive counts the datagrams received by the group until none is received for the timeout
+func receive(c *net.UDPConn, timeout time.Duration) int {
+	b := make([]byte, 2048)
+	n := 0
+	for {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		if _, err := c.Read(b); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+func TestQUICStreamsAuthenticated(t *testing.T) {
+	const count = 200
+	address := startQUIC(t, nil)
+	conn, hs, err := dialQUIC(t, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hs.Authenticated {
+		t.Fatal("client not authenticated")
+	}
+	if hs.Capabilities&packet.CapEncryption != 0 {
+		t.Fatal("frame encryption granted to a QUIC client")
+	}
+
+	groups := listenGroups(t, 4)
+	var wg sync.WaitGroup
+	for _, g := range groups {
+		g := g
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sendStream(conn, hs, g.LocalAddr().(*net.UDPAddr), count); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, g := range groups {
+		if n := receive(g, time.Second); n != count {
+			t.Errorf("group %s: received %d datagrams, expected %d", g.LocalAddr(), n, count)
+		}
+	}
+}
+
+func TestQUICPolicyAddress(t *testing.T) {
+	const count = 50
+	groups := listenGroups(t, 2)
+	allowed := groups[0].LocalAddr().(*net.UDPAddr)
+	var p policy.Policy
+	for _, s := range []string{"addr:127.0.0.1=" + allowed.String(), "*=deny"} {
+		r, err := policy.ParseRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Rules = append(p.Rules, r)
+	}
+	address := startQUIC(t, &p)
+	conn, hs, err := dialQUIC(t, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, g := range groups {
+		if err = sendStream(conn, hs, g.LocalAddr().(*net.UDPAddr), count); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := receive(groups[0], time.Second); n != count {
+		t.Errorf("allowed group: received %d datagrams, expected %d", n, count)
+	}
+	if n := receive(groups[1], 100*time.Millisecond); n != 0 {
+		t.Errorf("denied group: received %d datagrams, expected none", n)
+	}
+}
@@ -2,27 +2,83 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"github.com/bytedance/gopkg/lang/mcache"
 	constants "github.com/mgeri/udptunneler/pkg"
-	"github.com/mgeri/udptunneler/pkg/frame"
+	"github.com/mgeri/udptunneler/pkg/auth"
+	"github.com/mgeri/udptunneler/pkg/compress"
+	"github.com/mgeri/udptunneler/pkg/dedup"
+	"github.com/mgeri/udptunneler/pkg/encrypt"
+	"github.com/mgeri/udptunneler/pkg/handshake"
+	"github.com/mgeri/udptunneler/pkg/mcast"
 	"github.com/mgeri/udptunneler/pkg/packet"
+	"github.com/mgeri/udptunneler/pkg/policy"
+	"github.com/mgeri/udptunneler/pkg/publisher"
+	"github.com/mgeri/udptunneler/pkg/queue"
+	"github.com/mgeri/udptunneler/pkg/rawudp"
+	"github.com/mgeri/udptunneler/pkg/route"
+	"github.com/mgeri/udptunneler/pkg/transport"
 	"github.com/mgeri/udptunneler/pkg/util"
 	"github.com/spf13/cobra"
 	"io"
 	"log"
 	"net"
-	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	listenerAddress string
+	quicAddress     string
 	udpAddress      string
 	dumpBytes       bool
+	tlsCert         string
+	tlsKey          string
+	tlsCA           string
+	mcastInterface  string
+	mcastTTL        int
+	mcastHopLimit   int
+	mcastLoopback   bool
+	allowSources    []string
+	denySources     []string
+	spoofSource     bool
+	idleTimeout     time.Duration
+	routeRules      []string
+	routesFile      string
+	unmatched       string
 
-	udpConn        *net.UDPConn
-	udpConnections = make(map[string]*net.UDPConn)
+	joinAddresses       []string
+	joinInterface       string
+	joinSources         []string
+	joinExcludedSources []string
+	maxDatagramSize     int
+	queueSize           int
+	queuePolicy         string
+	dedupWindow         time.Duration
+	statsInterval       time.Duration
+	clockOffset         bool
+	heartbeatTimeout    time.Duration
+	compressLevel       string
+	compressDict        string
+	compressOptions     *compress.Options
+	keysFile            string
+	keys                auth.Keys
+	requireEncryption   bool
+	policyFile          string
+	policies            *policy.Policy
+
+	allowedSources []*net.IPNet
+	deniedSources  []*net.IPNet
+
+	routes       *route.Table
+	rawConn      *rawudp.Conn
+	publishers   *publisher.Registry
+	subscribers  *streams
+	joined       *mcast.Listener // nil without joined channels
+	published    *dedup.Cache
+	clients      *peers
+	capabilities uint32 = packet.SupportedCapabilities
 
 	Cmd = &cobra.Command{
 		Use:   "server",
@@ -35,40 +91,254 @@ var (
 func init() {
 	Cmd.PersistentFlags().StringVarP(&listenerAddress, "listener", "l", ":5055",
 		"the tcp server listener address and port used to listen for client connections")
+	Cmd.PersistentFlags().StringVar(&quicAddress, "quic-listener", "",
+		"the udp address and port used to listen for QUIC client connections (requires --tls-cert and --tls-key), in addition to the tcp listener")
 	Cmd.PersistentFlags().StringVarP(&udpAddress, "address", "a", "",
 		"the udp destination address (ip:port) where the server is publishing the forwarded datagrams. If not provided, datagrams are published on the same channel joined by the client")
 	Cmd.PersistentFlags().BoolVarP(&dumpBytes, "dump", "d", false,
 		"dump the raw bytes of the message")
+	Cmd.PersistentFlags().StringArrayVarP(&routeRules, "route", "r", nil,
+		"a rule mapping the datagrams of a channel to another destination, as match=target (see README). Can be repeated, rules are evaluated in order after the routes file")
+	Cmd.PersistentFlags().StringVar(&routesFile, "routes-file", "",
+		"the file containing the routes, one match=target rule per line")
+	Cmd.PersistentFlags().StringVar(&unmatched, "unmatched", UnmatchedForward,
+		"what to do with the datagrams not matched by any route: "+UnmatchedForward+" (publish on the same channel) or "+UnmatchedDrop)
+	Cmd.PersistentFlags().StringVarP(&mcastInterface, "interface", "i", "",
+		"the network interface used to publish the datagrams on multicast groups (default the zone of IPv6 addresses, or the system default)")
+	Cmd.PersistentFlags().IntVar(&mcastTTL, "ttl", 1,
+		"the time to live of the datagrams published on IPv4 multicast groups")
+	Cmd.PersistentFlags().IntVar(&mcastHopLimit, "hop-limit", 1,
+		"the hop limit of the datagrams published on IPv6 multicast groups")
+	Cmd.PersistentFlags().BoolVar(&mcastLoopback, "loopback", true,
+		"loop back the published multicast datagrams to the receivers on the server host")
+	Cmd.PersistentFlags().DurationVar(&idleTimeout, "idle-timeout", 5*time.Minute,
+		"the time after which a publishing socket no longer used by any client is closed")
+	Cmd.PersistentFlags().StringSliceVar(&allowSources, "allow-source", nil,
+		"the source addresses (ip or cidr) of the datagrams allowed to be published, as reported by the client. Can be repeated or comma separated")
+	Cmd.PersistentFlags().StringSliceVar(&denySources, "deny-source", nil,
+		"the source addresses (ip or cidr) of the datagrams refused, as reported by the client. Can be repeated or comma separated")
+	Cmd.PersistentFlags().BoolVar(&spoofSource, "spoof-source", false,
+		"publish the IPv4 datagrams with the original source address and port reported by the client, through a raw socket (linux only, requires CAP_NET_RAW)")
+	Cmd.PersistentFlags().StringSliceVar(&joinAddresses, "join", nil,
+		"the channel joined by the server and streamed to the clients in reverse mode, as ip:port[@interface]. Can be repeated or comma separated to join many channels")
+	Cmd.PersistentFlags().StringVar(&joinInterface, "join-interface", "",
+		"the network interface used to join the channels without an explicit interface")
+	Cmd.PersistentFlags().StringSliceVar(&joinSources, "join-source", nil,
+		"the source IP of a source-specific multicast (S,G) joined channel. Can be repeated or comma separated, applied to all the joined channels")
+	Cmd.PersistentFlags().StringSliceVar(&joinExcludedSources, "join-exclude-source", nil,
+		"the source IP whose datagrams are blocked on any-source joined channels. Can be repeated or comma separated, applied to all the joined channels")
+	Cmd.PersistentFlags().IntVar(&maxDatagramSize, "max-datagram-size", constants.DefaultDatagramSize,
+		"the max size of the datagrams received from the joined channels, larger datagrams are discarded (max 65507)")
+	Cmd.PersistentFlags().IntVar(&queueSize, "queue-size", 1024,
+		"the max number of datagrams buffered for every client in reverse mode while waiting to be sent")
+	Cmd.PersistentFlags().StringVar(&queuePolicy, "queue-policy", queue.PolicyDropOldest,
+		"the datagram dropped when the queue of a client is full: "+queue.PolicyDropOldest+" or "+queue.PolicyDropNewest)
+	Cmd.PersistentFlags().DurationVar(&dedupWindow, "dedup-window", time.Second,
+		"the time a published datagram is remembered, to discard it when re-captured from the joined channels instead of sending it back to the clients (0 = disabled)")
+	Cmd.PersistentFlags().DurationVar(&statsInterval, "stats-interval", 0,
+		"the interval between the logs of the statistics of the clients and of the publishers (0 = disabled)")
+	Cmd.PersistentFlags().BoolVar(&clockOffset, "clock-offset", false,
+		"compensate the latency of the datagrams with the clock offset of the client, measured with the heartbeat round trips (when the clocks are not synchronized)")
+	Cmd.PersistentFlags().DurationVar(&heartbeatTimeout, "heartbeat-timeout", constants.DefaultHeartbeatTimeout*time.Second,
+		"the time without any packet after which a client is considered dead, for the clients not announcing their own heartbeat timeout")
+	Cmd.PersistentFlags().StringVar(&compressLevel, "compress-level", "default",
+		"the zstd compression level of the frames sent to the clients requesting the compression: fastest, default, better or best")
+	Cmd.PersistentFlags().StringVar(&compressDict, "compress-dict", "",
+		"the zstd dictionary file trained on sample traffic (see the dict command), the clients have to use the same dictionary")
+	Cmd.PersistentFlags().StringVar(&keysFile, "keys-file", "",
+		"the file of the pre-shared keys of the clients, one 'client-id key' per line. When provided, the clients are authenticated with a challenge and the unknown ones are refused")
+	Cmd.PersistentFlags().BoolVar(&requireEncryption, "require-encryption", false,
+		"refuse the clients not requesting the encryption of the frames (requires --keys-file)")
+	Cmd.PersistentFlags().StringVar(&policyFile, "policy-file", "",
+		"the file of the policy rules, one 'client=groups [rate=datagrams] [bytes=bytes]' per line. When provided, each client publishes only to the groups of the first rule selecting it, and the clients selected by no rule are refused")
+	Cmd.PersistentFlags().StringVar(&tlsCert, "tls-cert", "",
+		"the tls certificate file (PEM) used to accept tls connections from the clients")
+	Cmd.PersistentFlags().StringVar(&tlsKey, "tls-key", "",
+		"the tls private key file (PEM) of the server certificate")
+	Cmd.PersistentFlags().StringVar(&tlsCA, "tls-ca", "",
+		"the CA file (PEM) used to verify the client certificates. If provided, clients are required to present a valid certificate (mutual TLS)")
+}
+
+// peer holds the state of a connected client
+type peer struct {
+	conn     net.Conn
+	clientID string // client id sent with the hello packet
+	identity string // verified tls client certificate identity, or authenticated client id, empty otherwise
+	denied   uint64 // datagrams refused by the source access lists
+	dropped  uint64 // datagrams discarded by the routes
+
+	wmu  sync.Mutex // serializes the writes of the responses and of the streamed datagrams
+	hmu  sync.Mutex // serializes the handling of the datagrams received on the streams of a QUIC client
+	wbuf *bufio.Writer
+
+	heartbeatTimeout time.Duration // read deadline, announced by the client with the heartbeats
+	compression      *compress.Codec
+	authorization    *authorization // policy rule of the client, nil without policy
+
+	mu            sync.Mutex          // protects the counters, read by the statistics
+	channels      map[string]*channel // by multicast group
+	anomalies     uint64              // gaps and out of order datagrams, to throttle the logs
+	offset        time.Duration       // clock of the server minus clock of the client
+	offsetSamples uint64
+}
+
+// key identifies the client in the publisher registry
+func (p *peer) key() string {
+	return p.conn.RemoteAddr().String()
+}
+
+func (p *peer) String() string {
+	if p.identity != "" {
+		return fmt.Sprintf("%s/%s", p.conn.RemoteAddr(), p.identity)
+	}
+	return p.conn.RemoteAddr().String()
 }
 
 func server(cmd *cobra.Command, args []string) error {
 
+	var err error
+	allowedSources, err = util.ParseCIDRs(allowSources)
+	if err != nil {
+		return err
+	}
+	deniedSources, err = util.ParseCIDRs(denySources)
+	if err != nil {
+		return err
+	}
+
+	compressOptions, err = compress.NewOptions(compressLevel, compressDict)
+	if err != nil {
+		return err
+	}
+	if keysFile != "" {
+		keys, err = auth.LoadKeys(keysFile)
+		if err != nil {
+			return err
+		}
+		log.Printf("authenticating the clients with %d keys", len(keys))
+	}
+	if requireEncryption && keys == nil {
+		return fmt.Errorf("the encryption requires the pre-shared keys of the --keys-file flag")
+	}
+	if policyFile != "" {
+		policies, err = policy.LoadFile(policyFile)
+		if err != nil {
+			return err
+		}
+		for _, r := range policies.Rules {
+			log.Printf("policy: %s", r)
+		}
+	}
+
+	publishOptions := &publisher.Options{
+		TTL:      mcastTTL,
+		HopLimit: mcastHopLimit,
+		Loopback: mcastLoopback,
+	}
+	if mcastInterface != "" {
+		publishOptions.Interface, err = net.InterfaceByName(mcastInterface)
+		if err != nil {
+			return err
+		}
+	}
+
+	if spoofSource {
+		rawConn, err = rawudp.Open()
+		if err != nil {
+			return err
+		}
+		defer rawConn.Close()
+		err = rawConn.SetMulticastOptions(publishOptions.Interface, mcastTTL, mcastLoopback)
+		if err != nil {
+			return err
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if tlsCert != "" || tlsKey != "" || tlsCA != "" {
+		tlsConfig, err = util.ServerTLSConfig(tlsCert, tlsKey, tlsCA)
+		if err != nil {
+			return err
+		}
+	}
+
 	l, err := net.Listen("tcp", listenerAddress)
 	if err != nil {
-		log.Println(err)
+		return err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
 	}
 
 	defer l.Close()
 
-	if udpAddress != "" {
-		addr, err := net.ResolveUDPAddr("udp4", udpAddress)
+	var ql *transport.Listener
+	if quicAddress != "" {
+		if tlsConfig == nil {
+			return fmt.Errorf("the QUIC listener requires the tls certificate and key")
+		}
+		ql, err = transport.Listen(quicAddress, tlsConfig)
 		if err != nil {
 			return err
 		}
-		udpConn, err = net.DialUDP("udp4", nil, addr)
-		defer udpConn.Close()
+		defer ql.Close()
 	}
 
-	// udp connections cleanup
-	defer func() {
-		for _, value := range udpConnections {
-			if value != nil {
-				value.Close()
-			}
+	routes, err = loadRoutes()
+	if err != nil {
+		return err
+	}
+	for _, r := range routes.Rules {
+		log.Printf("route: %s", r)
+	}
+
+	publishers = publisher.NewRegistry(publishOptions.Dial, idleTimeout)
+	defer publishers.Close()
+
+	clients = &peers{m: make(map[*peer]struct{})}
+
+	// join the channels streamed to the clients in reverse mode
+	subscribers = newStreams()
+	if len(joinAddresses) > 0 {
+		// validate the queue flags before accepting any client
+		if _, err = queue.New(queueSize, queuePolicy); err != nil {
+			return err
+		}
+		if maxDatagramSize < 1 || maxDatagramSize > constants.MaxDatagramSize {
+			return fmt.Errorf("invalid max datagram size [%d], expected 1..%d", maxDatagramSize, constants.MaxDatagramSize)
+		}
+		groups, err := mcast.ParseGroups(joinAddresses, joinInterface, joinSources, joinExcludedSources)
+		if err != nil {
+			return err
 		}
-	}()
+		listener, err := mcast.Listen(groups)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		joined = listener
+		for _, g := range listener.Groups() {
+			log.Printf("listening multicast to %s", g)
+		}
+		published = dedup.New(dedupWindow)
+		go func() {
+			err := listener.Serve(packet.MaxDatagramPacketHeaderLen, maxDatagramSize, subscribers.receive)
+			if err != nil {
+				log.Printf("multicast listener error: %s", err)
+			}
+		}()
+		capabilities |= packet.CapReverse
+	}
 
-	log.Printf("listening: %s", listenerAddress)
+	if statsInterval > 0 {
+		go logStats(statsInterval)
+	}
+
+	log.Printf("listening: %s (tls %v, mutual tls %v)", listenerAddress, tlsConfig != nil, tlsCA != "")
+	if ql != nil {
+		log.Printf("listening: quic %s (mutual tls %v)", quicAddress, tlsCA != "")
+		go serveQUIC(ql)
+	}
 
 	for {
 		c, err := l.Accept()
@@ -84,50 +354,160 @@ func server(cmd *cobra.Command, args []string) error {
 
 func handleConn(c net.Conn) {
 	defer c.Close()
-	frameCodec := frame.NewFrameCodec()
 	rbuf := bufio.NewReader(c)
 	wbuf := bufio.NewWriter(c)
 
 	log.Printf("handleConn[%s <-> %s] new connection", c.RemoteAddr(), c.LocalAddr())
 
+	pr := &peer{conn: c, wbuf: wbuf, channels: make(map[string]*channel), heartbeatTimeout: heartbeatTimeout}
+	defer publishers.Release(pr.key())
+	if tc, ok := c.(*tls.Conn); ok {
+		// complete the tls handshake now to know the client identity before accepting any packet
+		tc.SetDeadline(time.Now().Add(constants.DefaultHandshakeTimeout * time.Second))
+		err := tc.Handshake()
+		tc.SetDeadline(time.Time{})
+		if err != nil {
+			log.Printf("handleConn[%s] tls handshake error: %s", c.RemoteAddr(), err)
+			return
+		}
+	}
+	// the QUIC connections are accepted once their tls handshake is completed
+	tlsIdentity := util.TLSIdentity(c)
+	pr.identity = tlsIdentity
+
+	// the QUIC connections are already encrypted with tls 1.3, and the frames of their streams are decoded
+	// concurrently, in any order, which the counters of the encrypted frames do not allow
+	qc, _ := c.(*transport.Conn)
+	offered := capabilities
+	if qc != nil {
+		offered &^= packet.CapEncryption
+	}
+
+	// no datagram is accepted before the handshake is completed
+	hs, err := handshake.Server(c, rbuf, wbuf, offered, keys)
+	if err != nil {
+		log.Printf("handleConn[%s] handshake error: %s", pr, err)
+		return
+	}
+	pr.clientID = hs.ClientID
+	if hs.Authenticated && pr.identity == "" {
+		pr.identity = hs.ClientID
+	}
+	frameCodec := hs.FrameCodec()
+	if hs.Capabilities&packet.CapEncryption != 0 {
+		frameCodec, err = encrypt.NewCodec(frameCodec, hs.SessionSecret, false)
+		if err != nil {
+			log.Printf("handleConn[%s] encryption error: %s", pr, err)
+			return
+		}
+	} else if requireEncryption && qc == nil {
+		log.Printf("handleConn[%s] client not requesting the encryption, refused", pr)
+		err = packet.WriteFrame(frameCodec, wbuf, &packet.Error{
+			Code:    packet.ErrorCodeUnauthorized,
+			Message: "encryption required",
+		})
+		if err != nil {
+			log.Printf("handleConn[%s] write error: %s", pr, err)
+		}
+		return
+	}
+	if policies != nil {
+		// tcp address, or udp address of the QUIC connections
+		client := &policy.Client{Addr: util.AddrIP(c.RemoteAddr()), TLSIdentity: tlsIdentity}
+		// the client id is trusted only when authenticated with the pre-shared key
+		if hs.Authenticated {
+			client.ClientID = hs.ClientID
+		}
+		rule := policies.Lookup(client)
+		if rule == nil {
+			log.Printf("handleConn[%s] client not authorized by the policy, refused", pr)
+			err = packet.WriteFrame(frameCodec, wbuf, &packet.Error{
+				Code:    packet.ErrorCodeUnauthorized,
+				Message: "client not authorized by the policy",
+			})
+			if err != nil {
+				log.Printf("handleConn[%s] write error: %s", pr, err)
+			}
+			return
+		}
+		pr.authorization = newAuthorization(rule)
+		log.Printf("handleConn[%s] policy: %s", pr, rule)
+	}
+	if hs.Capabilities&packet.CapCompression != 0 {
+		cc, err := compress.NewCodec(frameCodec, compressOptions)
+		if err != nil {
+			log.Printf("handleConn[%s] compression error: %s", pr, err)
+			return
+		}
+		defer cc.Close()
+		pr.compression = cc
+		frameCodec = cc
+	}
+	clients.add(pr)
+	defer clients.remove(pr)
+	defer pr.logChannels()
+	log.Printf("handleConn[%s] handshake completed: [id %s, version %d, capabilities %#x, authenticated %v, encrypted %v]",
+		pr, hs.ClientID, hs.Version, hs.Capabilities, hs.Authenticated, hs.Capabilities&packet.CapEncryption != 0)
+
+	if hs.Capabilities&packet.CapReverse != 0 {
+		q, err := subscribers.add(pr)
+		if err != nil {
+			log.Printf("handleConn[%s] stream error: %s", pr, err)
+			return
+		}
+		defer subscribers.remove(pr)
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			if err := stream(pr, frameCodec, hs.Capabilities, q, done); err != nil {
+				log.Printf("handleConn[%s] stream error: %s", pr, err)
+				c.Close()
+			}
+		}()
+		log.Printf("handleConn[%s] streaming the joined channels", pr)
+	}
+	if qc != nil {
+		// the connection is closed before waiting for the receivers of the streams and of the datagrams
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		defer c.Close()
+		receiveQUIC(pr, qc, frameCodec, &wg)
+	}
+
 	for {
 		// read from the connection
 
 		// decode the frame to get the payload the payload is not decoded packet
-		c.SetReadDeadline(time.Now().Add(constants.DefaultHeartbeatTimeout * time.Second))
+		c.SetReadDeadline(time.Now().Add(pr.heartbeatTimeout))
 		// buffer will be created by frame codec decode before read
 		framePayload, err := frameCodec.Decode(rbuf)
 		if err != nil {
 			if err == io.EOF {
-				log.Printf("handleConn[%s] disconnected", c.RemoteAddr().String())
+				log.Printf("handleConn[%s] disconnected", pr)
 			} else {
-				log.Printf("handleConn[%s] frame decode error: %s", c.RemoteAddr(), err)
+				log.Printf("handleConn[%s] frame decode error: %s", pr, err)
 			}
 			return
 		}
-		p, err := handlePacket(c, framePayload)
+		p, err := handlePacket(pr, framePayload, time.Now())
 		mcache.Free(framePayload)
 		if err != nil {
-			log.Printf("handleConn[%s] packet handle error: %s", c.RemoteAddr(), err)
+			log.Printf("handleConn[%s] packet handle error: %s", pr, err)
 		}
 
 		// write response
 		if p != nil {
-			buf := mcache.Malloc(p.Length())
-			err = p.Encode(buf)
-			if err != nil {
-				log.Printf("handleConn[%s] packet encode error: %s", c.RemoteAddr(), err)
-			}
-			err = frameCodec.Encode(wbuf, buf)
-			mcache.Free(buf)
+			pr.wmu.Lock()
+			err = packet.WriteFrame(frameCodec, wbuf, p)
+			pr.wmu.Unlock()
 			if err != nil {
-				log.Printf("handleConn[%s] frame encode error: %s", c.RemoteAddr(), err)
+				log.Printf("handleConn[%s] write error: %s", pr, err)
 			}
 		}
 	}
 }
 
-func handlePacket(clientCon net.Conn, framePayload []byte) (res packet.Packet, err error) {
+func handlePacket(pr *peer, framePayload []byte, received time.Time) (res packet.Packet, err error) {
 	var p packet.Packet
 	p, err = packet.Decode(framePayload)
 	if err != nil {
@@ -136,51 +516,100 @@ func handlePacket(clientCon net.Conn, framePayload []byte) (res packet.Packet, e
 
 	switch p.(type) {
 	case *packet.Heartbeat:
+		heartbeat := p.(*packet.Heartbeat)
+		if heartbeat.Timeout > 0 {
+			timeout := time.Duration(heartbeat.Timeout) * time.Millisecond
+			if timeout != pr.heartbeatTimeout {
+				pr.heartbeatTimeout = timeout
+				log.Printf("handleConn[%s] heartbeat interval %v, timeout %v", pr,
+					time.Duration(heartbeat.Interval)*time.Millisecond, timeout)
+			}
+		}
+		pr.measureOffset(heartbeat, received)
 		return p, nil
 	case *packet.Datagram:
-		datagram := p.(*packet.Datagram)
-		var c = udpConn
-		if c == nil {
-			addr := net.UDPAddr{
-				IP:   datagram.UdpIP,
-				Port: int(datagram.UdpPort),
-			}
-			conn, ok := udpConnections[addr.String()]
-			if !ok {
-				c, err = net.DialUDP("udp4", nil, &addr)
-				if err != nil {
-					return nil, err
-				}
-				udpConnections[addr.String()] = c
-			} else {
-				c = conn
-			}
+		return nil, handleDatagrams(pr, received, p.(*packet.Datagram))
+	case *packet.Batch:
+		return nil, handleDatagrams(pr, received, p.(*packet.Batch).Datagrams...)
+	default:
+		return nil, fmt.Errorf("unknown packet type")
+	}
+}
+
+// handleDatagrams publishes the datagrams forwarded by the client. The packets received on the streams of a QUIC
+// client are handled one at a time as well.
+func handleDatagrams(pr *peer, received time.Time, datagrams ...*packet.Datagram) (err error) {
+	pr.hmu.Lock()
+	defer pr.hmu.Unlock()
+	// a failing datagram does not prevent handling the others of the batch
+	for _, datagram := range datagrams {
+		if e := handleDatagram(pr, datagram, received); e != nil {
+			err = e
 		}
+	}
+	return err
+}
 
-		// make sure all data will be written to outbound stream
-		var f = datagram.DatagramPacket
-		for {
-			n, err := c.Write(f) // write the frame payload to outbound stream
-			if err != nil {
-				return nil, err
-			}
-			if n >= len(f) {
-				break
-			}
-			if n < len(f) {
-				f = f[n:]
-			}
+// handleDatagram publishes the datagram forwarded by the client
+func handleDatagram(pr *peer, datagram *packet.Datagram, received time.Time) error {
+	pr.account(datagram, received)
+	if !sourceAllowed(datagram) {
+		pr.denied++
+		if pr.denied&(pr.denied-1) == 0 {
+			log.Printf("handleConn[%s] datagram from source %s denied, %d datagrams denied so far",
+				pr, originString(datagram), pr.denied)
 		}
+		return nil
+	}
+	if !pr.authorize(datagram, received) {
+		return nil
+	}
+	dsts := destinations(datagram)
+	if len(dsts) == 0 {
+		pr.dropped++
+		if pr.dropped&(pr.dropped-1) == 0 {
+			log.Printf("handleConn[%s] datagram to %s dropped by routes, %d datagrams dropped so far",
+				pr, &net.UDPAddr{IP: datagram.UdpIP, Port: int(datagram.UdpPort)}, pr.dropped)
+		}
+		return nil
+	}
 
-		if dumpBytes {
-			log.Printf(strings.Repeat("-", 80))
-			log.Printf("src: %v, addr: %v, numBytes: %d\n",
-				clientCon.RemoteAddr().String(), c.RemoteAddr(), len(datagram.DatagramPacket))
-			util.DumpByteSlice(datagram.DatagramPacket)
+	// a failing destination does not prevent publishing to the others, errors are accounted per destination
+	var failed int
+	var err error
+	for _, dst := range dsts {
+		if err = publish(pr, datagram, dst); err != nil {
+			failed++
 		}
+	}
+	if failed == len(dsts) {
+		return fmt.Errorf("publish to all %d destinations failed, last error: %w", failed, err)
+	}
 
-		return nil, nil
-	default:
-		return nil, fmt.Errorf("unknown packet type")
+	return nil
+}
+
+// originString returns the address of the host which published the datagram, when provided by the client
+func originString(d *packet.Datagram) string {
+	src := d.Source()
+	if src == nil {
+		return "unknown"
+	}
+	return src.String()
+}
+
+// sourceAllowed checks the source address of the datagram against the source access lists.
+// When an allow list is configured, datagrams without source address are refused.
+func sourceAllowed(d *packet.Datagram) bool {
+	if len(allowedSources) == 0 && len(deniedSources) == 0 {
+		return true
+	}
+	src := d.Source()
+	if src == nil {
+		return len(allowedSources) == 0
+	}
+	if util.ContainsIP(deniedSources, src.IP) {
+		return false
 	}
+	return len(allowedSources) == 0 || util.ContainsIP(allowedSources, src.IP)
 }
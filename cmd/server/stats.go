@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"github.com/mgeri/udptunneler/pkg/latency"
+	"github.com/mgeri/udptunneler/pkg/packet"
+	"github.com/mgeri/udptunneler/pkg/sequence"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// peers is the set of the connected clients, reported by the statistics
+type peers struct {
+	mu sync.Mutex
+	m  map[*peer]struct{}
+}
+
+func (s *peers) add(pr *peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[pr] = struct{}{}
+}
+
+func (s *peers) remove(pr *peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, pr)
+}
+
+func (s *peers) list() []*peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*peer, 0, len(s.m))
+	for pr := range s.m {
+		list = append(list, pr)
+	}
+	return list
+}
+
+// channel holds the counters of the stream of datagrams of a multicast group
+type channel struct {
+	sequence sequence.Tracker
+	latency  latency.Histogram
+}
+
+func (c *channel) String() string {
+	if c.latency.Count == 0 {
+		return c.sequence.String()
+	}
+	return fmt.Sprintf("%s, latency %s", c.sequence.String(), &c.latency)
+}
+
+// account updates the counters of the multicast group of the datagram, received at the given time
+func (p *peer) account(d *packet.Datagram, received time.Time) {
+	group := (&net.UDPAddr{IP: d.UdpIP, Port: int(d.UdpPort)}).String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.channels[group]
+	if !ok {
+		c = &channel{}
+		p.channels[group] = c
+	}
+	if d.Flags&packet.DatagramFlagTimestamp != 0 {
+		// the timestamp is taken with the client clock
+		sent := time.Unix(0, d.Timestamp)
+		if clockOffset {
+			sent = sent.Add(p.offset)
+		}
+		c.latency.Observe(received.Sub(sent))
+	}
+	if d.Flags&packet.DatagramFlagSequence != 0 {
+		p.track(c, group, d.Sequence)
+	}
+}
+
+// track accounts the sequence number of the datagram in the stream of its multicast group
+func (p *peer) track(c *channel, group string, seq uint32) {
+	t := &c.sequence
+	gap := t.Track(seq)
+	if gap == 0 {
+		return
+	}
+
+	p.anomalies++
+	if p.anomalies&(p.anomalies-1) != 0 {
+		return
+	}
+	if gap > 0 {
+		log.Printf("handleConn[%s] %d datagrams lost on %s (%s)", p, gap, group, t.Stats)
+	} else {
+		log.Printf("handleConn[%s] datagram %d received out of order on %s (%s)", p, seq, group, t.Stats)
+	}
+}
+
+// measureOffset estimates the clock offset of the client with the heartbeat received at the given time,
+// assuming the same transit time in both directions
+func (p *peer) measureOffset(h *packet.Heartbeat, received time.Time) {
+	if h.Timestamp == 0 || h.RTT <= 0 {
+		return
+	}
+	sample := received.Sub(time.Unix(0, h.Timestamp)) - time.Duration(h.RTT)/2
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// smooth the jitter of the round trips
+	if p.offsetSamples == 0 {
+		p.offset = sample
+	} else {
+		p.offset += (sample - p.offset) / 8
+	}
+	p.offsetSamples++
+}
+
+// logChannels logs the counters of the streams received from the client
+func (p *peer) logChannels() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.compression != nil {
+		sent, received := p.compression.Stats()
+		log.Printf("handleConn[%s] compression: sent %s, received %s", p, sent, received)
+	}
+	if p.offsetSamples > 0 {
+		log.Printf("handleConn[%s] clock offset %v (compensated %v)", p, p.offset, clockOffset)
+	}
+	groups := make([]string, 0, len(p.channels))
+	for group := range p.channels {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		log.Printf("handleConn[%s] stream %s: %s", p, group, p.channels[group])
+	}
+}
+
+// logStats periodically logs the counters of the connected clients and of the publishers
+func logStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, pr := range clients.list() {
+			pr.logChannels()
+		}
+		for _, s := range publishers.Stats() {
+			log.Printf("publisher[%s] %d sent, %d errors", s.Destination, s.Sent, s.Errors)
+		}
+		if joined != nil {
+			log.Printf("joined channels: %d datagrams larger than %d bytes discarded", joined.Truncated(), maxDatagramSize)
+		}
+	}
+}
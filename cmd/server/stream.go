@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bytedance/gopkg/lang/mcache"
+	"github.com/mgeri/udptunneler/pkg/frame"
+	"github.com/mgeri/udptunneler/pkg/mcast"
+	"github.com/mgeri/udptunneler/pkg/packet"
+	"github.com/mgeri/udptunneler/pkg/queue"
+	"github.com/mgeri/udptunneler/pkg/util"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streams holds the queues of the clients in reverse mode, receiving the datagrams of the channels joined by the server
+type streams struct {
+	mu     sync.Mutex
+	queues map[*peer]*queue.Queue
+	looped uint64 // datagrams published by the server and re-captured from the joined channels
+}
+
+func newStreams() *streams {
+	return &streams{queues: make(map[*peer]*queue.Queue)}
+}
+
+// add subscribes the client to the joined channels
+func (s *streams) add(pr *peer) (*queue.Queue, error) {
+	q, err := queue.New(queueSize, queuePolicy)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queues[pr] = q
+	return q, nil
+}
+
+// remove unsubscribes the client, releasing the datagrams not sent yet
+func (s *streams) remove(pr *peer) {
+	s.mu.Lock()
+	q, ok := s.queues[pr]
+	delete(s.queues, pr)
+	s.mu.Unlock()
+	if ok {
+		q.Drain()
+	}
+}
+
+// receive copies the datagram received from a joined channel to the queue of every client in reverse mode.
+// The datagrams published by the server itself are not sent back to the clients.
+func (s *streams) receive(buffer []byte, numBytes int, g *mcast.Group, srcAddr net.Addr, _ time.Time) bool {
+	payload := buffer[packet.MaxDatagramPacketHeaderLen : packet.MaxDatagramPacketHeaderLen+numBytes]
+	if published.Contains(g.Addr.IP, g.Addr.Port, payload) {
+		s.mu.Lock()
+		s.looped++
+		if s.looped&(s.looped-1) == 0 {
+			log.Printf("datagram published by the server re-captured from %s, %d datagrams discarded so far", g, s.looped)
+		}
+		s.mu.Unlock()
+		return false
+	}
+	if dumpBytes {
+		log.Printf(strings.Repeat("-", 80))
+		log.Printf("group: %v, addr: %v, numBytes: %d\n", g, srcAddr, numBytes)
+		util.DumpByteSlice(payload)
+	}
+
+	src, _ := srcAddr.(*net.UDPAddr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range s.queues {
+		// every client owns its copy, released once sent
+		buf := mcache.Malloc(packet.MaxDatagramPacketHeaderLen + numBytes)
+		copy(buf[packet.MaxDatagramPacketHeaderLen:], payload)
+		d := &packet.Datagram{
+			DatagramLength: uint16(numBytes),
+			UdpIP:          g.Addr.IP,
+			UdpPort:        uint16(g.Addr.Port),
+			DatagramPacket: buf,
+		}
+		if src != nil {
+			d.SrcIP = src.IP
+			d.SrcPort = uint16(src.Port)
+		}
+		q.Push(d)
+	}
+	return false
+}
+
+// stream sends the queued datagrams to the client until the connection is closed
+func stream(pr *peer, frameCodec frame.StreamFrameCodec, capabilities uint32, q *queue.Queue, done <-chan struct{}) error {
+	var unsupported, oversized uint64
+	for {
+		select {
+		case <-done:
+			return nil
+		case d := <-q.C:
+			if !d.Negotiate(capabilities) {
+				// the client can not handle IPv6 addresses
+				mcache.Free(d.DatagramPacket)
+				unsupported++
+				if unsupported&(unsupported-1) == 0 {
+					log.Printf("handleConn[%s] client does not support IPv6, %d datagrams dropped so far", pr, unsupported)
+				}
+				continue
+			}
+			if d.Length() > frameCodec.MaxPayloadLen() {
+				// the client does not support the large frames
+				mcache.Free(d.DatagramPacket)
+				oversized++
+				if oversized&(oversized-1) == 0 {
+					log.Printf("handleConn[%s] datagram of %d bytes too large for the client frames, %d datagrams dropped so far",
+						pr, d.DatagramLength, oversized)
+				}
+				continue
+			}
+			pr.wmu.Lock()
+			err := packet.WriteDatagram(frameCodec, pr.wbuf, d)
+			pr.wmu.Unlock()
+			if err != nil {
+				return fmt.Errorf("write error while sending datagram: %w", err)
+			}
+		}
+	}
+}
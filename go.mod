@@ -1,15 +1,25 @@
 module github.com/mgeri/udptunneler
 
-go 1.19
+go 1.21
 
 require (
 	github.com/bytedance/gopkg v0.0.0-20221122125632-68358b8ecec6
+	github.com/klauspost/compress v1.17.4
+	github.com/quic-go/quic-go v0.41.0
 	github.com/spf13/cobra v1.6.1
-	golang.org/x/net v0.7.0
+	golang.org/x/net v0.10.0
 )
 
 require (
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/sys v0.5.0 // indirect
+	go.uber.org/mock v0.3.0 // indirect
+	golang.org/x/crypto v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
+	golang.org/x/mod v0.11.0 // indirect
+	golang.org/x/sys v0.8.0 // indirect
+	golang.org/x/tools v0.9.1 // indirect
 )
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// NonceLen is the length of the challenge sent by the server
+	NonceLen = 32
+	// MACLen is the length of the response of the client, a HMAC-SHA256
+	MACLen = sha256.Size
+	// MinKeyLen is the min length of a pre-shared key
+	MinKeyLen = 16
+)
+
+// context binds the MAC to the udptunneler authentication, a key shared with other applications can not be abused
+const context = "udptunneler-auth-v1"
+
+// sessionContext binds the session secret to the udptunneler sessions, it is never sent on the wire unlike the MAC
+const sessionContext = "udptunneler-session-v1"
+
+// Keys are the pre-shared keys of the clients, by client id
+type Keys map[string][]byte
+
+// LoadKeys reads the keys of the clients from a file with one client per line, as the client id followed by its key
+// separated by spaces. Empty lines and lines starting with # are ignored.
+func LoadKeys(path string) (Keys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(Keys)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		fields := strings.Fields(s)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: invalid key, expected client id and key", path, line)
+		}
+		if _, ok := keys[fields[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicated client id [%s]", path, line, fields[0])
+		}
+		if len(fields[1]) < MinKeyLen {
+			return nil, fmt.Errorf("%s:%d: key of client id [%s] too short, min %d characters", path, line, fields[0], MinKeyLen)
+		}
+		keys[fields[0]] = []byte(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no key found", path)
+	}
+	return keys, nil
+}
+
+// LoadKey reads the key of a client, the first line of the file which is not empty or a comment
+func LoadKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range strings.Split(string(b), "\n") {
+		s = strings.TrimSpace(s)
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		if len(s) < MinKeyLen {
+			return nil, fmt.Errorf("%s: key too short, min %d characters", path, MinKeyLen)
+		}
+		return []byte(s), nil
+	}
+	return nil, fmt.Errorf("%s: no key found", path)
+}
+
+// NewNonce returns a random challenge
+func NewNonce() ([]byte, error) {
+	nonce := make([]byte, NonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// Sign returns the response of the client to the challenge of the server
+func Sign(key []byte, nonce []byte, clientID string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(context))
+	mac.Write(nonce)
+	mac.Write([]byte(clientID))
+	return mac.Sum(nil)
+}
+
+// SessionSecret returns the secret of the session authenticated with the challenge, known only by the client and
+// the server. It is the root of the keys of the encrypted frames. Both peers contribute a random nonce, so that a
+// replayed challenge never leads to the keys of another session. The transcript is the negotiation of the session as
+// seen by each peer: the peers agree on the secret only if they exchanged the same packets.
+func SessionSecret(key []byte, nonce []byte, clientNonce []byte, clientID string, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sessionContext))
+	mac.Write(nonce)
+	mac.Write(clientNonce)
+	mac.Write([]byte(clientID))
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
+
+// Verify tells whether the response of the client to the challenge is signed with the key of the client.
+// The unknown clients are refused the same way as the clients with a wrong key.
+func (k Keys) Verify(clientID string, nonce []byte, response []byte) bool {
+	key, ok := k[clientID]
+	if !ok {
+		// the same amount of work does not tell the known client ids apart
+		key = []byte(context)
+	}
+	return hmac.Equal(Sign(key, nonce, clientID), response) && ok
+}
@@ -0,0 +1,194 @@
+package compress
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/bytedance/gopkg/lang/mcache"
+	"github.com/klauspost/compress/zstd"
+	"github.com/mgeri/udptunneler/pkg/frame"
+	"github.com/mgeri/udptunneler/pkg/packet"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// MinLength is the min length of a frame payload worth to be compressed
+const MinLength = 64
+
+// Options are the settings of the compression, shared by the peers of the connections
+type Options struct {
+	Level      string // zstd encoder level: fastest, default, better or best
+	Dictionary []byte // zstd dictionary, the same dictionary has to be used by both peers
+}
+
+// NewOptions validates the compression level and loads the dictionary file, if provided
+func NewOptions(level string, dictionaryFile string) (*Options, error) {
+	if ok, _ := zstd.EncoderLevelFromString(level); !ok {
+		return nil, fmt.Errorf("invalid compression level [%s], expected fastest, default, better or best", level)
+	}
+	o := &Options{Level: level}
+	if dictionaryFile == "" {
+		return o, nil
+	}
+	var err error
+	o.Dictionary, err = os.ReadFile(dictionaryFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = zstd.InspectDictionary(o.Dictionary); err != nil {
+		return nil, fmt.Errorf("invalid compression dictionary [%s]: %w", dictionaryFile, err)
+	}
+	return o, nil
+}
+
+// Stats are the counters of the frames of a direction of a connection
+type Stats struct {
+	Frames     uint64 // frames
+	Compressed uint64 // frames sent compressed, the others are sent as they are
+	Bytes      uint64 // bytes of the frame payloads
+	WireBytes  uint64 // bytes of the frame payloads once compressed
+}
+
+// Ratio returns the compression ratio, the bytes of the payloads over the bytes sent on the wire
+func (s Stats) Ratio() float64 {
+	if s.WireBytes == 0 {
+		return 1
+	}
+	return float64(s.Bytes) / float64(s.WireBytes)
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d frames (%d compressed), %d bytes in %d bytes, ratio %.2f",
+		s.Frames, s.Compressed, s.Bytes, s.WireBytes, s.Ratio())
+}
+
+func (s *Stats) account(bytes int, wireBytes int) {
+	atomic.AddUint64(&s.Frames, 1)
+	if wireBytes < bytes {
+		atomic.AddUint64(&s.Compressed, 1)
+	}
+	atomic.AddUint64(&s.Bytes, uint64(bytes))
+	atomic.AddUint64(&s.WireBytes, uint64(wireBytes))
+}
+
+func (s *Stats) load() Stats {
+	return Stats{
+		Frames:     atomic.LoadUint64(&s.Frames),
+		Compressed: atomic.LoadUint64(&s.Compressed),
+		Bytes:      atomic.LoadUint64(&s.Bytes),
+		WireBytes:  atomic.LoadUint64(&s.WireBytes),
+	}
+}
+
+// Codec compresses the frames encoded by the wrapped codec into compressed packets, and decompresses the compressed
+// packets it decodes. The frames not worth to be compressed are sent as they are.
+// Encode and Decode can be used concurrently with each other, but Encode is not safe for concurrent use as the writes
+// of a stream.
+type Codec struct {
+	codec    frame.StreamFrameCodec
+	encoder  *zstd.Encoder
+	decoder  *zstd.Decoder
+	scratch  []byte // compressed payload being encoded
+	sent     Stats
+	received Stats
+}
+
+// NewCodec wraps the codec with the zstd compression. The codec has to be closed once the connection is closed.
+func NewCodec(codec frame.StreamFrameCodec, o *Options) (*Codec, error) {
+	ok, level := zstd.EncoderLevelFromString(o.Level)
+	if !ok {
+		return nil, fmt.Errorf("invalid compression level [%s], expected fastest, default, better or best", o.Level)
+	}
+	eopts := []zstd.EOption{zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(level)}
+	// the decompressed packets can not be larger than a frame
+	dopts := []zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(codec.MaxPayloadLen()))}
+	if len(o.Dictionary) > 0 {
+		eopts = append(eopts, zstd.WithEncoderDict(o.Dictionary))
+		dopts = append(dopts, zstd.WithDecoderDicts(o.Dictionary))
+	}
+	encoder, err := zstd.NewWriter(nil, eopts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compression settings: %w", err)
+	}
+	decoder, err := zstd.NewReader(nil, dopts...)
+	if err != nil {
+		encoder.Close()
+		return nil, fmt.Errorf("invalid compression settings: %w", err)
+	}
+	return &Codec{
+		codec:   codec,
+		encoder: encoder,
+		decoder: decoder,
+		scratch: make([]byte, packet.CompressedPacketHeaderLen),
+	}, nil
+}
+
+// Encode compresses the frame payload if smaller once compressed
+func (c *Codec) Encode(w io.Writer, framePayload frame.FramePayload) error {
+	if len(framePayload) < MinLength {
+		c.sent.account(len(framePayload), len(framePayload))
+		return c.codec.Encode(w, framePayload)
+	}
+	c.scratch = c.encoder.EncodeAll(framePayload, c.scratch[:packet.CompressedPacketHeaderLen])
+	if len(c.scratch) >= len(framePayload) {
+		// not compressible, e.g. already compressed or encrypted data
+		c.sent.account(len(framePayload), len(framePayload))
+		return c.codec.Encode(w, framePayload)
+	}
+	c.scratch[0] = packet.TypeCompressed
+	c.scratch[1] = packet.CompressionZstd
+	binary.LittleEndian.PutUint32(c.scratch[2:6], uint32(len(framePayload)))
+	c.sent.account(len(framePayload), len(c.scratch))
+	return c.codec.Encode(w, c.scratch)
+}
+
+// Decode decompresses the compressed packets, the other frame payloads are returned as they are
+func (c *Codec) Decode(r io.Reader) (frame.FramePayload, error) {
+	framePayload, err := c.codec.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(framePayload) == 0 || framePayload[0] != packet.TypeCompressed {
+		c.received.account(len(framePayload), len(framePayload))
+		return framePayload, nil
+	}
+	defer mcache.Free(framePayload)
+
+	p := packet.Compressed{}
+	if err = p.Decode(framePayload); err != nil {
+		return nil, err
+	}
+	if p.Algorithm != packet.CompressionZstd {
+		return nil, fmt.Errorf("unsupported compression algorithm [%d]", p.Algorithm)
+	}
+	if p.OriginalLength == 0 || int(p.OriginalLength) > c.codec.MaxPayloadLen() {
+		return nil, fmt.Errorf("invalid decompressed length [%d]", p.OriginalLength)
+	}
+	buf := mcache.Malloc(int(p.OriginalLength))
+	out, err := c.decoder.DecodeAll(p.Data, buf[:0])
+	if err != nil {
+		mcache.Free(buf)
+		return nil, fmt.Errorf("decompression error: %w", err)
+	}
+	if len(out) != len(buf) || &out[0] != &buf[0] {
+		mcache.Free(buf)
+		return nil, fmt.Errorf("invalid decompressed length [%d], expected [%d]", len(out), p.OriginalLength)
+	}
+	c.received.account(len(buf), len(framePayload))
+	return buf, nil
+}
+
+func (c *Codec) MaxPayloadLen() int {
+	return c.codec.MaxPayloadLen()
+}
+
+// Stats returns the counters of the frames sent and received
+func (c *Codec) Stats() (sent Stats, received Stats) {
+	return c.sent.load(), c.received.load()
+}
+
+// Close releases the encoder and the decoder
+func (c *Codec) Close() {
+	c.encoder.Close()
+	c.decoder.Close()
+}
@@ -1,6 +1,9 @@
 package constants
 
 const (
-	DefaultHeartbeatTimeout = 10
-	MaxDatagramSize         = 2000
+	DefaultHeartbeatTimeout  = 10
+	DefaultHeartbeatInterval = DefaultHeartbeatTimeout / 2
+	DefaultHandshakeTimeout  = 10
+	DefaultDatagramSize      = 2000
+	MaxDatagramSize          = 65507 // max udp payload over IPv4
 )
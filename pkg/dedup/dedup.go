@@ -0,0 +1,81 @@
+package dedup
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+)
+
+// Cache remembers the datagrams recently published by the tunnel, so that they are recognized when re-captured
+// from the same channel and are not sent back to the peer.
+// Datagrams are identified by channel and content: an identical datagram published by another host on the same
+// channel within the window is recognized as well. A nil cache remembers nothing.
+type Cache struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	entries   map[uint64]time.Time // expiration by datagram hash
+	lastPurge time.Time
+}
+
+// New creates a cache remembering the datagrams for the given window, nil if the window is not positive
+func New(window time.Duration) *Cache {
+	if window <= 0 {
+		return nil
+	}
+	return &Cache{
+		window:    window,
+		entries:   make(map[uint64]time.Time),
+		lastPurge: time.Now(),
+	}
+}
+
+// Add remembers the datagram published on the channel
+func (c *Cache) Add(ip net.IP, port int, payload []byte) {
+	if c == nil {
+		return
+	}
+	key := hash(ip, port, payload)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = now.Add(c.window)
+	if now.Sub(c.lastPurge) >= c.window {
+		c.purge(now)
+	}
+}
+
+// Contains tells whether the datagram received from the channel has been recently published
+func (c *Cache) Contains(ip net.IP, port int, payload []byte) bool {
+	if c == nil {
+		return false
+	}
+	key := hash(ip, port, payload)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiration, ok := c.entries[key]
+	return ok && time.Now().Before(expiration)
+}
+
+func (c *Cache) purge(now time.Time) {
+	for key, expiration := range c.entries {
+		if !now.Before(expiration) {
+			delete(c.entries, key)
+		}
+	}
+	c.lastPurge = now
+}
+
+func hash(ip net.IP, port int, payload []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(ip.To16())
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], uint16(port))
+	h.Write(buf[:])
+	h.Write(payload)
+	return h.Sum64()
+}
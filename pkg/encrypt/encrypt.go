@@ -0,0 +1,172 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/bytedance/gopkg/lang/mcache"
+	"github.com/mgeri/udptunneler/pkg/frame"
+	"io"
+)
+
+/*
+Encrypted frame payload: counter + sealed packet
+
+counter: uint64 => number of the frame in its direction, starting from 0. It is the nonce of the frame, a frame
+received with a counter not following the previous one is rejected (replayed or missing frames)
+sealed packet: variable []byte => packet encrypted with AES-256-GCM, followed by the 16 bytes of the authentication tag
+
+Each direction has its own key, derived from the session secret agreed during the handshake. Every RekeyFrames frames
+the key of a direction is replaced by a new key derived from the previous one, which is then forgotten.
+*/
+
+const (
+	// CounterLen is the length of the frame counter preceding the sealed packet
+	CounterLen = 8
+	// Overhead is the number of bytes added to the frame payloads
+	Overhead = CounterLen + 16
+	// RekeyFrames is the number of frames encrypted with the same key
+	RekeyFrames = 1 << 24
+)
+
+// contexts of the key derivations
+const (
+	clientContext = "udptunneler-encrypt-v1 client to server"
+	serverContext = "udptunneler-encrypt-v1 server to client"
+	rekeyContext  = "udptunneler-rekey-v1"
+)
+
+// direction is the key and the frame counter of a direction of the connection
+type direction struct {
+	key     []byte
+	aead    cipher.AEAD
+	epoch   uint64 // number of rekeys
+	counter uint64 // counter of the next frame
+	nonce   [12]byte
+}
+
+func newDirection(secret []byte, context string) (*direction, error) {
+	d := &direction{key: derive(secret, context)}
+	if err := d.init(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *direction) init() error {
+	block, err := aes.NewCipher(d.key)
+	if err != nil {
+		return err
+	}
+	d.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+// prepare rekeys when the counter enters a new epoch, and returns the nonce of the counter
+func (d *direction) prepare(counter uint64) ([]byte, error) {
+	if epoch := counter / RekeyFrames; epoch != d.epoch {
+		d.key = derive(d.key, rekeyContext)
+		d.epoch = epoch
+		if err := d.init(); err != nil {
+			return nil, err
+		}
+	}
+	binary.LittleEndian.PutUint64(d.nonce[4:], counter)
+	return d.nonce[:], nil
+}
+
+// derive returns a 32 bytes key bound to the context
+func derive(secret []byte, context string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(context))
+	return mac.Sum(nil)
+}
+
+// Codec encrypts the frames encoded by the wrapped codec, and decrypts the frames it decodes. Each direction counts
+// its frames, so a Codec belongs to a single ordered stream of frames per direction: Encode and Decode can be used
+// concurrently with each other, but neither can be shared by many goroutines or many streams, whose frames would
+// break the sequence of the counters and be rejected.
+type Codec struct {
+	codec   frame.StreamFrameCodec
+	send    *direction
+	receive *direction
+	scratch []byte // encrypted payload being encoded
+}
+
+// NewCodec wraps the codec with the encryption, with the keys derived from the session secret shared by the peers.
+// The client and the server sides of the connection use opposite keys.
+func NewCodec(codec frame.StreamFrameCodec, secret []byte, client bool) (*Codec, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("no session secret, the encryption requires an authenticated session")
+	}
+	c2s, err := newDirection(secret, clientContext)
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := newDirection(secret, serverContext)
+	if err != nil {
+		return nil, err
+	}
+	c := &Codec{codec: codec, send: c2s, receive: s2c}
+	if !client {
+		c.send, c.receive = s2c, c2s
+	}
+	return c, nil
+}
+
+// Encode encrypts the frame payload with the next counter
+func (c *Codec) Encode(w io.Writer, framePayload frame.FramePayload) error {
+	if len(framePayload) > c.MaxPayloadLen() {
+		return fmt.Errorf("invalid frame payload length [%d], max [%d]", len(framePayload), c.MaxPayloadLen())
+	}
+	counter := c.send.counter
+	nonce, err := c.send.prepare(counter)
+	if err != nil {
+		return err
+	}
+	c.send.counter++
+	c.scratch = binary.LittleEndian.AppendUint64(c.scratch[:0], counter)
+	c.scratch = c.send.aead.Seal(c.scratch, nonce, framePayload, nil)
+	return c.codec.Encode(w, c.scratch)
+}
+
+// Decode decrypts the frame payload, rejecting the frames failing the authentication or out of sequence
+func (c *Codec) Decode(r io.Reader) (frame.FramePayload, error) {
+	framePayload, err := c.codec.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(framePayload) < Overhead {
+		mcache.Free(framePayload)
+		return nil, fmt.Errorf("invalid encrypted frame length [%d]", len(framePayload))
+	}
+	counter := binary.LittleEndian.Uint64(framePayload)
+	if counter != c.receive.counter {
+		mcache.Free(framePayload)
+		if counter < c.receive.counter {
+			return nil, fmt.Errorf("replayed frame [%d], expected [%d]", counter, c.receive.counter)
+		}
+		return nil, fmt.Errorf("unexpected frame [%d], expected [%d]", counter, c.receive.counter)
+	}
+	nonce, err := c.receive.prepare(counter)
+	if err != nil {
+		mcache.Free(framePayload)
+		return nil, err
+	}
+	// decrypted in place, then moved at the start of the buffer which is released by the caller
+	out, err := c.receive.aead.Open(framePayload[CounterLen:CounterLen], nonce, framePayload[CounterLen:], nil)
+	if err != nil {
+		mcache.Free(framePayload)
+		return nil, fmt.Errorf("frame [%d] authentication failed", counter)
+	}
+	c.receive.counter++
+	return framePayload[:copy(framePayload, out)], nil
+}
+
+func (c *Codec) MaxPayloadLen() int {
+	return c.codec.MaxPayloadLen() - Overhead
+}
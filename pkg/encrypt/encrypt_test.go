@@ -0,0 +1,145 @@
+package encrypt
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mgeri/udptunneler/pkg/frame"
+	"strings"
+	"testing"
+)
+
+var secret = bytes.Repeat([]byte{0x5a}, 32)
+
+// peers returns the codecs of the client and of the server sides of a connection
+func peers(t *testing.T) (client *Codec, server *Codec) {
+	t.Helper()
+	client, err := NewCodec(frame.NewFrameCodec(), secret, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = NewCodec(frame.NewFrameCodec(), secret, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// encode returns the encrypted frame of the payload
+func encode(t *testing.T, c *Codec, payload string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := c.Encode(&b, []byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	client, server := peers(t)
+	for _, c := range []struct {
+		name     string
+		from, to *Codec
+	}{
+		{"client to server", client, server},
+		{"server to client", server, client},
+	} {
+		for i := 0; i < 3; i++ {
+			payload := fmt.Sprintf("%s #%d", c.name, i)
+			b := encode(t, c.from, payload)
+			if bytes.Contains(b, []byte(payload)) {
+				t.Fatalf("%s: payload sent in clear", c.name)
+			}
+			got, err := c.to.Decode(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("%s: %s", c.name, err)
+			}
+			if string(got) != payload {
+				t.Fatalf("%s: decoded [%s], expected [%s]", c.name, got, payload)
+			}
+		}
+	}
+}
+
+func TestSameDirectionKeys(t *testing.T) {
+	// a frame sent by the client is not accepted as a frame of the server
+	client, _ := peers(t)
+	other, err := NewCodec(frame.NewFrameCodec(), secret, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.Decode(bytes.NewReader(encode(t, client, "reflected"))); err == nil {
+		t.Fatal("frame reflected to its sender accepted")
+	}
+}
+
+func TestTampered(t *testing.T) {
+	for _, offset := range []int{2, 2 + CounterLen, 2 + CounterLen + 3} {
+		client, server := peers(t)
+		b := encode(t, client, "payload")
+		b[offset] ^= 0x01
+		if _, err := server.Decode(bytes.NewReader(b)); err == nil {
+			t.Fatalf("frame tampered at offset %d accepted", offset)
+		}
+	}
+}
+
+func TestReplayed(t *testing.T) {
+	client, server := peers(t)
+	first := encode(t, client, "first")
+	if _, err := server.Decode(bytes.NewReader(first)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := server.Decode(bytes.NewReader(first))
+	if err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Fatalf("replayed frame: error %v", err)
+	}
+}
+
+func TestReordered(t *testing.T) {
+	client, server := peers(t)
+	first := encode(t, client, "first")
+	second := encode(t, client, "second")
+	_, err := server.Decode(bytes.NewReader(second))
+	if err == nil || !strings.Contains(err.Error(), "unexpected") {
+		t.Fatalf("reordered frame: error %v", err)
+	}
+	if _, err = server.Decode(bytes.NewReader(first)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.Decode(bytes.NewReader(second)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	client, server := peers(t)
+	// skips to the last frames of the first key, as if already exchanged
+	client.send.counter = RekeyFrames - 2
+	server.receive.counter = RekeyFrames - 2
+	first := append([]byte(nil), client.send.key...)
+	for i := 0; i < 4; i++ {
+		payload := fmt.Sprintf("frame #%d", i)
+		got, err := server.Decode(bytes.NewReader(encode(t, client, payload)))
+		if err != nil {
+			t.Fatalf("frame %d across the rekey: %s", i, err)
+		}
+		if string(got) != payload {
+			t.Fatalf("decoded [%s], expected [%s]", got, payload)
+		}
+	}
+	if bytes.Equal(first, client.send.key) || !bytes.Equal(client.send.key, server.receive.key) {
+		t.Fatal("key not replaced by both peers")
+	}
+	if !bytes.Equal(client.send.key, derive(first, rekeyContext)) {
+		t.Fatal("key not derived from the previous one")
+	}
+}
+
+func TestNoSecret(t *testing.T) {
+	// keys derived from an empty secret would be known to anyone
+	for _, s := range [][]byte{nil, {}} {
+		if _, err := NewCodec(frame.NewFrameCodec(), s, true); err == nil {
+			t.Fatal("codec created without session secret")
+		}
+	}
+}
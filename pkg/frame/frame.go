@@ -2,18 +2,30 @@ package frame
 
 import (
 	"encoding/binary"
+	"fmt"
 	"github.com/bytedance/gopkg/lang/mcache"
 	"io"
+	"math"
 )
 
 /*
 Frame: frameHeader + framePayload(packet)
 
-frameHeader: uint16, 2 bytes => length of frame payload (Packet)
+frameHeader: uint16, 2 bytes => length of frame (header included)
+framePayload: Packet
+
+Large Frame: largeFrameHeader + framePayload(packet), used after the handshake from protocol version 2
+
+largeFrameHeader: uint32, 4 bytes => length of frame (header included)
 framePayload: Packet
 */
 const (
-	FrameHeaderLen = 2
+	FrameHeaderLen      = 2
+	LargeFrameHeaderLen = 4
+
+	MaxFrameLen = math.MaxUint16
+	// MaxLargeFrameLen protects the receiver from allocating huge buffers for a corrupted frame length
+	MaxLargeFrameLen = 1 << 20
 )
 
 type FramePayload []byte
@@ -21,6 +33,8 @@ type FramePayload []byte
 type StreamFrameCodec interface {
 	Encode(io.Writer, FramePayload) error
 	Decode(io.Reader) (FramePayload, error)
+	// MaxPayloadLen returns the max length of a frame payload
+	MaxPayloadLen() int
 }
 
 type frameCodec struct{}
@@ -30,13 +44,73 @@ func NewFrameCodec() StreamFrameCodec {
 }
 
 func (p *frameCodec) Encode(w io.Writer, framePayload FramePayload) error {
-	var f = framePayload
+	if len(framePayload) > p.MaxPayloadLen() {
+		return fmt.Errorf("invalid frame payload length [%d], max [%d]", len(framePayload), p.MaxPayloadLen())
+	}
 	var totalLen = uint16(len(framePayload)) + FrameHeaderLen
 
 	err := binary.Write(w, binary.LittleEndian, &totalLen)
 	if err != nil {
 		return err
 	}
+	return writePayload(w, framePayload)
+}
+
+func (p *frameCodec) Decode(r io.Reader) (FramePayload, error) {
+	var totalLen uint16
+	err := binary.Read(r, binary.LittleEndian, &totalLen)
+	if err != nil {
+		return nil, err
+	}
+	if totalLen < FrameHeaderLen {
+		return nil, fmt.Errorf("invalid frame length [%d]", totalLen)
+	}
+	return readPayload(r, int(totalLen-FrameHeaderLen))
+}
+
+func (p *frameCodec) MaxPayloadLen() int {
+	return MaxFrameLen - FrameHeaderLen
+}
+
+type largeFrameCodec struct{}
+
+// NewLargeFrameCodec returns the codec of the frames with a uint32 length, carrying the jumbo datagrams and the
+// large batches
+func NewLargeFrameCodec() StreamFrameCodec {
+	return &largeFrameCodec{}
+}
+
+func (p *largeFrameCodec) Encode(w io.Writer, framePayload FramePayload) error {
+	if len(framePayload) > p.MaxPayloadLen() {
+		return fmt.Errorf("invalid frame payload length [%d], max [%d]", len(framePayload), p.MaxPayloadLen())
+	}
+	var totalLen = uint32(len(framePayload)) + LargeFrameHeaderLen
+
+	err := binary.Write(w, binary.LittleEndian, &totalLen)
+	if err != nil {
+		return err
+	}
+	return writePayload(w, framePayload)
+}
+
+func (p *largeFrameCodec) Decode(r io.Reader) (FramePayload, error) {
+	var totalLen uint32
+	err := binary.Read(r, binary.LittleEndian, &totalLen)
+	if err != nil {
+		return nil, err
+	}
+	if totalLen < LargeFrameHeaderLen || totalLen > MaxLargeFrameLen {
+		return nil, fmt.Errorf("invalid frame length [%d]", totalLen)
+	}
+	return readPayload(r, int(totalLen-LargeFrameHeaderLen))
+}
+
+func (p *largeFrameCodec) MaxPayloadLen() int {
+	return MaxLargeFrameLen - LargeFrameHeaderLen
+}
+
+func writePayload(w io.Writer, framePayload FramePayload) error {
+	var f = framePayload
 
 	// make sure all data will be written to outbound stream
 	for {
@@ -54,17 +128,12 @@ func (p *frameCodec) Encode(w io.Writer, framePayload FramePayload) error {
 	return nil
 }
 
-func (p *frameCodec) Decode(r io.Reader) (FramePayload, error) {
-	var totalLen uint16
-	err := binary.Read(r, binary.LittleEndian, &totalLen)
-	if err != nil {
-		return nil, err
-	}
-
-	buf := mcache.Malloc(int(totalLen - FrameHeaderLen))
-	_, err = io.ReadFull(r, buf)
+func readPayload(r io.Reader, length int) (FramePayload, error) {
+	buf := mcache.Malloc(length)
+	_, err := io.ReadFull(r, buf)
 
 	if err != nil {
+		mcache.Free(buf)
 		return nil, err
 	}
 	return buf, nil
@@ -0,0 +1,105 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		codec     StreamFrameCodec
+		headerLen int
+		length    int
+	}{
+		{"frame empty", NewFrameCodec(), FrameHeaderLen, 0},
+		{"frame", NewFrameCodec(), FrameHeaderLen, 1500},
+		{"frame max", NewFrameCodec(), FrameHeaderLen, MaxFrameLen - FrameHeaderLen},
+		{"large frame empty", NewLargeFrameCodec(), LargeFrameHeaderLen, 0},
+		{"large frame jumbo", NewLargeFrameCodec(), LargeFrameHeaderLen, 9000},
+		{"large frame over uint16", NewLargeFrameCodec(), LargeFrameHeaderLen, MaxFrameLen + 1},
+		{"large frame max", NewLargeFrameCodec(), LargeFrameHeaderLen, MaxLargeFrameLen - LargeFrameHeaderLen},
+	} {
+		payload := make([]byte, c.length)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		var b bytes.Buffer
+		if err := c.codec.Encode(&b, payload); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if b.Len() != c.headerLen+c.length {
+			t.Fatalf("%s: frame length [%d], expected [%d]", c.name, b.Len(), c.headerLen+c.length)
+		}
+		got, err := c.codec.Decode(&b)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("%s: payload differs", c.name)
+		}
+	}
+}
+
+func TestEncodeTooLarge(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		codec StreamFrameCodec
+	}{
+		{"frame", NewFrameCodec()},
+		{"large frame", NewLargeFrameCodec()},
+	} {
+		var b bytes.Buffer
+		if err := c.codec.Encode(&b, make([]byte, c.codec.MaxPayloadLen()+1)); err == nil {
+			t.Fatalf("%s: payload larger than the max encoded", c.name)
+		}
+		if b.Len() != 0 {
+			t.Fatalf("%s: [%d] bytes written for a payload too large", c.name, b.Len())
+		}
+	}
+}
+
+// largeHeader returns the header of a large frame of the given total length
+func largeHeader(totalLen uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, totalLen)
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	var frame bytes.Buffer
+	NewFrameCodec().Encode(&frame, []byte("payload"))
+	var largeFrame bytes.Buffer
+	NewLargeFrameCodec().Encode(&largeFrame, []byte("payload"))
+
+	for _, c := range []struct {
+		name  string
+		codec StreamFrameCodec
+		input []byte
+	}{
+		{"frame no header", NewFrameCodec(), nil},
+		{"frame truncated header", NewFrameCodec(), frame.Bytes()[:1]},
+		{"frame truncated payload", NewFrameCodec(), frame.Bytes()[:frame.Len()-1]},
+		{"frame length below header", NewFrameCodec(), []byte{1, 0}},
+		{"large frame no header", NewLargeFrameCodec(), nil},
+		{"large frame truncated header", NewLargeFrameCodec(), largeFrame.Bytes()[:3]},
+		{"large frame truncated payload", NewLargeFrameCodec(), largeFrame.Bytes()[:largeFrame.Len()-1]},
+		{"large frame length below header", NewLargeFrameCodec(), largeHeader(LargeFrameHeaderLen - 1)},
+		{"large frame length over max", NewLargeFrameCodec(), largeHeader(MaxLargeFrameLen + 1)},
+		{"large frame corrupted length", NewLargeFrameCodec(), largeHeader(0xffffffff)},
+	} {
+		if _, err := c.codec.Decode(bytes.NewReader(c.input)); err == nil {
+			t.Fatalf("%s: decoded", c.name)
+		}
+	}
+}
+
+func TestDecodeMaxLength(t *testing.T) {
+	input := append(largeHeader(MaxLargeFrameLen), make([]byte, MaxLargeFrameLen-LargeFrameHeaderLen)...)
+	got, err := NewLargeFrameCodec().Decode(bytes.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != MaxLargeFrameLen-LargeFrameHeaderLen {
+		t.Fatalf("payload length [%d]", len(got))
+	}
+}
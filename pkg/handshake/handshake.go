@@ -0,0 +1,237 @@
+package handshake
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/bytedance/gopkg/lang/mcache"
+	constants "github.com/mgeri/udptunneler/pkg"
+	"github.com/mgeri/udptunneler/pkg/auth"
+	"github.com/mgeri/udptunneler/pkg/frame"
+	"github.com/mgeri/udptunneler/pkg/packet"
+	"net"
+	"time"
+)
+
+// Result is the outcome of a successful handshake
+type Result struct {
+	ClientID      string
+	Version       uint16
+	Capabilities  uint32
+	Authenticated bool   // the client proved the knowledge of the pre-shared key of its client id
+	SessionSecret []byte // secret derived from the pre-shared key and the challenge, nil when not authenticated
+}
+
+// errNoKey is returned when the server requires the authentication and the client has no key
+var errNoKey = &packet.Error{
+	Code:    packet.ErrorCodeUnauthorized,
+	Message: "the server requires the authentication, no key provided",
+}
+
+// FrameCodec returns the codec of the frames following the handshake, depending on the negotiated protocol version
+func (r *Result) FrameCodec() frame.StreamFrameCodec {
+	if r.Version >= packet.LargeFramesVersion {
+		return frame.NewLargeFrameCodec()
+	}
+	return frame.NewFrameCodec()
+}
+
+// Client sends the hello packet to the server and waits for its acknowledgement, answering the challenge of the
+// servers requiring the authentication with the key (nil if not available).
+// If the server refuses the connection the received *packet.Error is returned as error.
+func Client(conn net.Conn, rbuf *bufio.Reader, wbuf *bufio.Writer, clientID string, capabilities uint32, key []byte) (*Result, error) {
+	frameCodec := frame.NewFrameCodec()
+
+	conn.SetDeadline(time.Now().Add(constants.DefaultHandshakeTimeout * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := packet.Hello{
+		Version:      packet.ProtocolVersion,
+		Capabilities: capabilities,
+		ClientID:     clientID,
+	}
+	err := packet.WriteFrame(frameCodec, wbuf, &hello)
+	if err != nil {
+		return nil, fmt.Errorf("error sending hello: %w", err)
+	}
+
+	p, framePayload, err := packet.ReadFrame(frameCodec, rbuf)
+	if err != nil {
+		return nil, fmt.Errorf("error receiving hello ack: %w", err)
+	}
+	defer mcache.Free(framePayload)
+
+	var nonce, clientNonce []byte
+	if challenge, ok := p.(*packet.Challenge); ok {
+		if key == nil {
+			return nil, errNoKey
+		}
+		// the nonce of the client makes the session secret unique, even with a challenge replayed by a rogue server
+		clientNonce, err = auth.NewNonce()
+		if err != nil {
+			return nil, err
+		}
+		response := packet.Response{MAC: auth.Sign(key, challenge.Nonce, clientID), Nonce: clientNonce}
+		err = packet.WriteFrame(frameCodec, wbuf, &response)
+		if err != nil {
+			return nil, fmt.Errorf("error sending challenge response: %w", err)
+		}
+		var responsePayload frame.FramePayload
+		p, responsePayload, err = packet.ReadFrame(frameCodec, rbuf)
+		if err != nil {
+			return nil, fmt.Errorf("error receiving hello ack: %w", err)
+		}
+		defer mcache.Free(responsePayload)
+		nonce = challenge.Nonce
+	}
+
+	switch p := p.(type) {
+	case *packet.HelloAck:
+		if p.Version < packet.MinProtocolVersion || p.Version > packet.ProtocolVersion {
+			return nil, fmt.Errorf("unsupported server protocol version [%d]", p.Version)
+		}
+		if p.Capabilities&^capabilities != 0 {
+			return nil, fmt.Errorf("server enabled unsupported capabilities [%#x]", p.Capabilities&^capabilities)
+		}
+		if p.Capabilities&packet.CapEncryption != 0 && nonce == nil {
+			// the keys would be known to anyone, a server not authenticating the client can not grant the encryption
+			return nil, fmt.Errorf("server enabled the encryption without authenticating the client")
+		}
+		var secret []byte
+		if nonce != nil {
+			secret = auth.SessionSecret(key, nonce, clientNonce, clientID, transcript(&hello, p))
+		}
+		return &Result{
+			ClientID:      clientID,
+			Version:       p.Version,
+			Capabilities:  p.Capabilities,
+			Authenticated: secret != nil,
+			SessionSecret: secret,
+		}, nil
+	case *packet.Error:
+		return nil, p
+	default:
+		return nil, fmt.Errorf("unexpected packet received during handshake: %T", p)
+	}
+}
+
+// Server waits for the client hello and negotiates the protocol version and the capabilities.
+// With the keys (nil if not required), the client is challenged to prove the knowledge of the key of its client id.
+// Incompatible or unauthenticated clients are notified with an error packet before returning the error, the caller
+// is expected to close the connection.
+func Server(conn net.Conn, rbuf *bufio.Reader, wbuf *bufio.Writer, capabilities uint32, keys auth.Keys) (*Result, error) {
+	frameCodec := frame.NewFrameCodec()
+
+	conn.SetDeadline(time.Now().Add(constants.DefaultHandshakeTimeout * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	p, framePayload, err := packet.ReadFrame(frameCodec, rbuf)
+	if err != nil {
+		return nil, fmt.Errorf("error receiving hello: %w", err)
+	}
+	defer mcache.Free(framePayload)
+
+	hello, ok := p.(*packet.Hello)
+	if !ok {
+		return nil, reject(frameCodec, wbuf, packet.ErrorCodeHandshakeRequired,
+			fmt.Sprintf("hello expected, received %T", p))
+	}
+
+	version := hello.Version
+	if version > packet.ProtocolVersion {
+		version = packet.ProtocolVersion
+	}
+	if version < packet.MinProtocolVersion {
+		return nil, reject(frameCodec, wbuf, packet.ErrorCodeUnsupportedVersion,
+			fmt.Sprintf("unsupported protocol version [%d], supported [%d-%d]",
+				hello.Version, packet.MinProtocolVersion, packet.ProtocolVersion))
+	}
+
+	var nonce, clientNonce []byte
+	if keys != nil {
+		nonce, clientNonce, err = authenticate(frameCodec, rbuf, wbuf, hello.ClientID, keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ack := packet.HelloAck{
+		Version:      version,
+		Capabilities: hello.Capabilities & capabilities,
+	}
+	if clientNonce == nil {
+		// the keys of the encrypted frames are derived from the pre-shared key and the nonces of both peers
+		ack.Capabilities &^= packet.CapEncryption
+	}
+	err = packet.WriteFrame(frameCodec, wbuf, &ack)
+	if err != nil {
+		return nil, fmt.Errorf("error sending hello ack: %w", err)
+	}
+	var secret []byte
+	if nonce != nil {
+		secret = auth.SessionSecret(keys[hello.ClientID], nonce, clientNonce, hello.ClientID, transcript(hello, &ack))
+	}
+
+	return &Result{
+		ClientID:      hello.ClientID,
+		Version:       ack.Version,
+		Capabilities:  ack.Capabilities,
+		Authenticated: secret != nil,
+		SessionSecret: secret,
+	}, nil
+}
+
+// transcript returns the negotiated versions and capabilities, covered by the session secret: the Hello and Hello Ack
+// packets are not authenticated, and a tampered negotiation (e.g. a stripped encryption capability) derives different
+// keys on the two peers, failing the first encrypted frame
+func transcript(hello *packet.Hello, ack *packet.HelloAck) []byte {
+	b := make([]byte, 0, 12)
+	b = binary.LittleEndian.AppendUint16(b, hello.Version)
+	b = binary.LittleEndian.AppendUint32(b, hello.Capabilities)
+	b = binary.LittleEndian.AppendUint16(b, ack.Version)
+	return binary.LittleEndian.AppendUint32(b, ack.Capabilities)
+}
+
+// authenticate challenges the client to sign a random nonce with the key of its client id, and returns the nonce
+// with the nonce of the client (nil for the older clients)
+func authenticate(frameCodec frame.StreamFrameCodec, rbuf *bufio.Reader, wbuf *bufio.Writer, clientID string, keys auth.Keys) ([]byte, []byte, error) {
+	nonce, err := auth.NewNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	challenge := packet.Challenge{Nonce: nonce}
+	err = packet.WriteFrame(frameCodec, wbuf, &challenge)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error sending challenge: %w", err)
+	}
+
+	p, framePayload, err := packet.ReadFrame(frameCodec, rbuf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error receiving challenge response: %w", err)
+	}
+	defer mcache.Free(framePayload)
+
+	response, ok := p.(*packet.Response)
+	if !ok {
+		return nil, nil, reject(frameCodec, wbuf, packet.ErrorCodeHandshakeRequired,
+			fmt.Sprintf("challenge response expected, received %T", p))
+	}
+	if !keys.Verify(clientID, nonce, response.MAC) {
+		// the reason is not disclosed to the client
+		err = reject(frameCodec, wbuf, packet.ErrorCodeUnauthorized, "authentication failed")
+		return nil, nil, fmt.Errorf("%w: invalid key or unknown client id [%s]", err, clientID)
+	}
+	return nonce, response.Nonce, nil
+}
+
+func reject(frameCodec frame.StreamFrameCodec, wbuf *bufio.Writer, code uint16, message string) error {
+	p := packet.Error{
+		Code:    code,
+		Message: message,
+	}
+	err := packet.WriteFrame(frameCodec, wbuf, &p)
+	if err != nil {
+		return fmt.Errorf("%s (error sending reject: %v)", message, err)
+	}
+	return fmt.Errorf("%s", message)
+}
@@ -0,0 +1,148 @@
+package handshake
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/bytedance/gopkg/lang/mcache"
+	"github.com/mgeri/udptunneler/pkg/auth"
+	"github.com/mgeri/udptunneler/pkg/frame"
+	"github.com/mgeri/udptunneler/pkg/packet"
+	"io"
+	"net"
+	"testing"
+)
+
+const (
+	testClientID = "client-1"
+	testKey      = "0123456789abcdef0123456789abcdef"
+)
+
+// run runs the handshake of a client with the server, through the relay of the frames sent by the client
+func run(t *testing.T, relay func(w io.Writer, r io.Reader)) (client *Result, server *Result) {
+	t.Helper()
+	clientConn, relayConn := net.Pipe()
+	serverConn, upstream := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go func() {
+		defer upstream.Close()
+		relay(upstream, relayConn)
+	}()
+	go io.Copy(relayConn, upstream)
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		server, err = Server(serverConn, bufio.NewReader(serverConn), bufio.NewWriter(serverConn), packet.SupportedCapabilities,
+			auth.Keys{testClientID: []byte(testKey)})
+		done <- err
+	}()
+	client, err := Client(clientConn, bufio.NewReader(clientConn), bufio.NewWriter(clientConn), testClientID,
+		packet.SupportedCapabilities, []byte(testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestSessionSecret(t *testing.T) {
+	client, server := run(t, func(w io.Writer, r io.Reader) { io.Copy(w, r) })
+	if client.Capabilities&packet.CapEncryption == 0 || client.Capabilities != server.Capabilities {
+		t.Fatalf("capabilities: client %#x, server %#x", client.Capabilities, server.Capabilities)
+	}
+	if client.SessionSecret == nil || !bytes.Equal(client.SessionSecret, server.SessionSecret) {
+		t.Fatal("client and server session secrets differ")
+	}
+}
+
+func TestSessionSecretTamperedHello(t *testing.T) {
+	// strips a capability of the hello, still acceptable by the client when missing from the hello ack
+	client, server := run(t, func(w io.Writer, r io.Reader) {
+		frameCodec := frame.NewFrameCodec()
+		rbuf := bufio.NewReader(r)
+		wbuf := bufio.NewWriter(w)
+		for {
+			p, framePayload, err := packet.ReadFrame(frameCodec, rbuf)
+			if err != nil {
+				return
+			}
+			if hello, ok := p.(*packet.Hello); ok {
+				hello.Capabilities &^= packet.CapCompression
+			}
+			err = packet.WriteFrame(frameCodec, wbuf, p)
+			mcache.Free(framePayload)
+			if err != nil {
+				return
+			}
+		}
+	})
+	if client.Capabilities&packet.CapEncryption == 0 {
+		t.Fatal("encryption not granted")
+	}
+	if bytes.Equal(client.SessionSecret, server.SessionSecret) {
+		t.Fatal("same session secrets with a tampered hello")
+	}
+}
+
+// rogue plays a server granting every capability requested by the client, after the challenge when not nil
+func rogue(conn net.Conn, challenge []byte) {
+	defer conn.Close()
+	frameCodec := frame.NewFrameCodec()
+	rbuf := bufio.NewReader(conn)
+	wbuf := bufio.NewWriter(conn)
+	p, framePayload, err := packet.ReadFrame(frameCodec, rbuf)
+	if err != nil {
+		return
+	}
+	hello := p.(*packet.Hello)
+	mcache.Free(framePayload)
+	if challenge != nil {
+		if packet.WriteFrame(frameCodec, wbuf, &packet.Challenge{Nonce: challenge}) != nil {
+			return
+		}
+		if _, framePayload, err = packet.ReadFrame(frameCodec, rbuf); err != nil {
+			return
+		}
+		mcache.Free(framePayload)
+	}
+	packet.WriteFrame(frameCodec, wbuf, &packet.HelloAck{Version: hello.Version, Capabilities: hello.Capabilities})
+	io.Copy(io.Discard, conn)
+}
+
+// dialRogue runs the handshake of a client with a rogue server
+func dialRogue(challenge []byte) (*Result, error) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go rogue(serverConn, challenge)
+	return Client(clientConn, bufio.NewReader(clientConn), bufio.NewWriter(clientConn), testClientID,
+		packet.SupportedCapabilities, []byte(testKey))
+}
+
+func TestEncryptionWithoutChallenge(t *testing.T) {
+	// the keys would derive from an empty secret, known to the rogue server
+	if hs, err := dialRogue(nil); err == nil {
+		t.Fatalf("encryption granted without challenge accepted, capabilities %#x", hs.Capabilities)
+	}
+}
+
+func TestReplayedChallenge(t *testing.T) {
+	// a recorded challenge replayed by a rogue server must not reuse the keys (and the nonces) of the recorded session
+	challenge := bytes.Repeat([]byte{0x42}, packet.ChallengeNonceLen)
+	first, err := dialRogue(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := dialRogue(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Capabilities&packet.CapEncryption == 0 {
+		t.Fatal("encryption not granted")
+	}
+	if bytes.Equal(first.SessionSecret, second.SessionSecret) {
+		t.Fatal("same session secrets with a replayed challenge")
+	}
+}
@@ -0,0 +1,103 @@
+package latency
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Bounds are the upper bounds of the histogram buckets, the last bucket holds the greater latencies
+var Bounds = []time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+}
+
+// Histogram accounts the distribution of a set of latencies
+type Histogram struct {
+	Counts []uint64 // by bucket, len(Bounds)+1 once observed
+	Count  uint64
+	Sum    time.Duration
+	Min    time.Duration
+	Max    time.Duration
+}
+
+// Observe accounts a latency. Negative latencies, because of the clock offset between the hosts, are accounted as well.
+func (h *Histogram) Observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(Bounds)+1)
+	}
+	i := 0
+	for i < len(Bounds) && d > Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+
+	if h.Count == 0 || d < h.Min {
+		h.Min = d
+	}
+	if h.Count == 0 || d > h.Max {
+		h.Max = d
+	}
+	h.Count++
+	h.Sum += d
+}
+
+// Mean returns the average latency
+func (h *Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns the upper bound of the bucket holding the q quantile (0..1), the max latency for the last bucket
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.Count))
+	if rank >= h.Count {
+		rank = h.Count - 1
+	}
+	var seen uint64
+	for i, n := range h.Counts {
+		seen += n
+		if seen > rank {
+			if i < len(Bounds) && Bounds[i] < h.Max {
+				return Bounds[i]
+			}
+			return h.Max
+		}
+	}
+	return h.Max
+}
+
+func (h *Histogram) String() string {
+	if h.Count == 0 {
+		return "no samples"
+	}
+	var buckets []string
+	for i, n := range h.Counts {
+		if n == 0 {
+			continue
+		}
+		if i < len(Bounds) {
+			buckets = append(buckets, fmt.Sprintf("<=%v:%d", Bounds[i], n))
+		} else {
+			buckets = append(buckets, fmt.Sprintf(">%v:%d", Bounds[len(Bounds)-1], n))
+		}
+	}
+	return fmt.Sprintf("min %v, avg %v, p50 %v, p99 %v, max %v [%s]",
+		h.Min, h.Mean().Round(time.Microsecond), h.Quantile(0.5), h.Quantile(0.99), h.Max, strings.Join(buckets, " "))
+}
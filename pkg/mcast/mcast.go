@@ -0,0 +1,375 @@
+package mcast
+
+import (
+	"fmt"
+	"github.com/bytedance/gopkg/lang/mcache"
+	"github.com/mgeri/udptunneler/pkg/util"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Group is a multicast channel to join, optionally on a specific network interface.
+// When Sources is provided the group is joined as source-specific multicast (S,G) for every source, otherwise it is
+// joined as any-source multicast, optionally blocking the ExcludedSources.
+type Group struct {
+	Addr            *net.UDPAddr
+	Interface       *net.Interface // nil means the system default interface
+	Sources         []net.IP
+	ExcludedSources []net.IP
+}
+
+func (g *Group) String() string {
+	s := fmt.Sprintf("%s@default", g.Addr)
+	if g.Interface != nil {
+		s = fmt.Sprintf("%s@%s", g.Addr, g.Interface.Name)
+	}
+	if len(g.Sources) > 0 {
+		s += fmt.Sprintf(" sources %v", g.Sources)
+	}
+	if len(g.ExcludedSources) > 0 {
+		s += fmt.Sprintf(" excluded sources %v", g.ExcludedSources)
+	}
+	return s
+}
+
+// IsIPv6 tells whether the group is an IPv6 multicast group
+func (g *Group) IsIPv6() bool {
+	return g.Addr.IP.To4() == nil
+}
+
+// SetSources sets the included and the excluded sources of the group
+func (g *Group) SetSources(sources []string, excludedSources []string) error {
+	if len(sources) > 0 && len(excludedSources) > 0 {
+		return fmt.Errorf("included and excluded sources can not be used together")
+	}
+	var err error
+	g.Sources, err = g.parseSources(sources)
+	if err != nil {
+		return err
+	}
+	g.ExcludedSources, err = g.parseSources(excludedSources)
+	return err
+}
+
+// parseSources parses the source addresses, which must be of the address family of the group: a group left without
+// its sources would be joined as any-source
+func (g *Group) parseSources(list []string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, s := range list {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source address [%s]", s)
+		}
+		if (ip.To4() == nil) != g.IsIPv6() {
+			return nil, fmt.Errorf("source address [%s] not of the address family of the group %s", s, g.Addr)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// ParseGroup parses a multicast channel in the form ip:port[@interface], or [ipv6]:port[@interface] for IPv6.
+// When the interface is not provided, the IPv6 zone or the defaultInterface is used (empty means the system default).
+func ParseGroup(s string, defaultInterface string) (*Group, error) {
+	address, intfName, found := strings.Cut(s, "@")
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		intfName = util.StringIfEmpty(addr.Zone, defaultInterface)
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, fmt.Errorf("invalid multicast address [%s]", address)
+	}
+	g := &Group{Addr: addr}
+	if intfName != "" {
+		g.Interface, err = net.InterfaceByName(intfName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface [%s]: %w", intfName, err)
+		}
+	}
+	return g, nil
+}
+
+// ParseGroups parses a list of multicast channels, see ParseGroup. The provided sources are set to every group.
+func ParseGroups(list []string, defaultInterface string, sources []string, excludedSources []string) ([]*Group, error) {
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no multicast address provided")
+	}
+	groups := make([]*Group, 0, len(list))
+	for _, s := range list {
+		g, err := ParseGroup(s, defaultInterface)
+		if err != nil {
+			return nil, err
+		}
+		err = g.SetSources(sources, excludedSources)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// Handler is called for every datagram received from a joined group. The datagram is stored in
+// buffer[header:header+numBytes], received is the kernel receive timestamp when available (linux), otherwise the time
+// the datagram was read. Returning true the handler takes the ownership of the buffer (and has to release it
+// with mcache.Free), otherwise the buffer is reused for the next datagram.
+type Handler func(buffer []byte, numBytes int, group *Group, src net.Addr, received time.Time) bool
+
+// Listener receives the datagrams of a set of multicast groups, with one socket for every address family and udp port
+type Listener struct {
+	sockets []*socket
+}
+
+// joiner is implemented by both ipv4.PacketConn and ipv6.PacketConn
+type joiner interface {
+	JoinGroup(ifi *net.Interface, group net.Addr) error
+	LeaveGroup(ifi *net.Interface, group net.Addr) error
+	JoinSourceSpecificGroup(ifi *net.Interface, group net.Addr, source net.Addr) error
+	LeaveSourceSpecificGroup(ifi *net.Interface, group net.Addr, source net.Addr) error
+	ExcludeSourceSpecificGroup(ifi *net.Interface, group net.Addr, source net.Addr) error
+}
+
+type socket struct {
+	ipv6      bool
+	port      int
+	conn      *net.UDPConn
+	oob       []byte // control messages of the last datagram read
+	pc4       *ipv4.PacketConn
+	pc6       *ipv6.PacketConn
+	pc        joiner
+	groups    []*Group
+	truncated uint64 // datagrams larger than the max datagram size, discarded
+}
+
+// Listen joins all the provided groups
+func Listen(groups []*Group) (*Listener, error) {
+	l := &Listener{}
+	for _, g := range groups {
+		if err := l.join(g); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *Listener) join(g *Group) error {
+	var s *socket
+	for _, v := range l.sockets {
+		if v.port == g.Addr.Port && v.ipv6 == g.IsIPv6() {
+			s = v
+			break
+		}
+	}
+	if s == nil {
+		var err error
+		s, err = newSocket(g)
+		if err != nil {
+			return err
+		}
+		l.sockets = append(l.sockets, s)
+	}
+	if err := s.joinGroup(g); err != nil {
+		return fmt.Errorf("failed to join %s: %w", g, err)
+	}
+	s.groups = append(s.groups, g)
+	return nil
+}
+
+func newSocket(g *Group) (*socket, error) {
+	s := &socket{
+		ipv6: g.IsIPv6(),
+		port: g.Addr.Port,
+	}
+	network := "udp4"
+	if s.ipv6 {
+		network = "udp6"
+	}
+	// binding to a multicast address gives a wildcard socket with a reusable port, shared by the groups on that port
+	c, err := net.ListenPacket(network, g.Addr.String())
+	if err != nil {
+		return nil, err
+	}
+	s.conn = c.(*net.UDPConn)
+	if s.ipv6 {
+		flags := ipv6.FlagHopLimit | ipv6.FlagSrc | ipv6.FlagDst | ipv6.FlagInterface
+		s.pc6 = ipv6.NewPacketConn(s.conn)
+		s.pc = s.pc6
+		s.oob = ipv6.NewControlMessage(flags)
+		err = s.pc6.SetControlMessage(flags, true)
+	} else {
+		flags := ipv4.FlagTTL | ipv4.FlagSrc | ipv4.FlagDst | ipv4.FlagInterface
+		s.pc4 = ipv4.NewPacketConn(s.conn)
+		s.pc = s.pc4
+		s.oob = ipv4.NewControlMessage(flags)
+		err = s.pc4.SetControlMessage(flags, true)
+	}
+	if err == nil {
+		err = enableTimestamps(s.conn)
+	}
+	if err != nil {
+		s.conn.Close()
+		return nil, err
+	}
+	s.oob = append(s.oob, make([]byte, timestampSpace)...)
+	return s, nil
+}
+func (s *socket) joinGroup(g *Group) error {
+	if len(g.Sources) > 0 {
+		for _, src := range g.Sources {
+			err := s.pc.JoinSourceSpecificGroup(g.Interface, g.Addr, &net.UDPAddr{IP: src})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := s.pc.JoinGroup(g.Interface, g.Addr); err != nil {
+		return err
+	}
+	for _, src := range g.ExcludedSources {
+		err := s.pc.ExcludeSourceSpecificGroup(g.Interface, g.Addr, &net.UDPAddr{IP: src})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *socket) leaveGroup(g *Group) {
+	if len(g.Sources) > 0 {
+		for _, src := range g.Sources {
+			s.pc.LeaveSourceSpecificGroup(g.Interface, g.Addr, &net.UDPAddr{IP: src})
+		}
+		return
+	}
+	s.pc.LeaveGroup(g.Interface, g.Addr)
+}
+
+// Groups returns the joined groups
+func (l *Listener) Groups() []*Group {
+	var groups []*Group
+	for _, s := range l.sockets {
+		groups = append(groups, s.groups...)
+	}
+	return groups
+}
+
+// Serve reads the datagrams from all the sockets, calling the handler for each datagram received from a joined group.
+// Every read buffer reserves header bytes in front of the datagram. The datagrams larger than size bytes are
+// discarded, rather than forwarded truncated. Serve returns at the first read error.
+func (l *Listener) Serve(header int, size int, handler Handler) error {
+	errc := make(chan error, len(l.sockets))
+	for _, s := range l.sockets {
+		go func(s *socket) {
+			errc <- s.serve(header, size, handler)
+		}(s)
+	}
+	return <-errc
+}
+
+// Truncated returns the number of datagrams discarded because larger than the max datagram size
+func (l *Listener) Truncated() uint64 {
+	var n uint64
+	for _, s := range l.sockets {
+		n += atomic.LoadUint64(&s.truncated)
+	}
+	return n
+}
+
+func (s *socket) serve(header int, size int, handler Handler) error {
+	var buffer []byte
+	// Loop forever reading from the socket
+	for {
+		if buffer == nil {
+			// the extra byte detects the truncated datagrams when the kernel does not report them
+			buffer = mcache.Malloc(header + size + 1)
+		}
+
+		numBytes, flags, dst, ifIndex, srcAddr, received, err := s.readFrom(buffer[header:])
+		if err != nil {
+			mcache.Free(buffer)
+			return fmt.Errorf("read from udp failed: %w", err)
+		}
+		if numBytes > size || flags&msgTrunc != 0 {
+			n := atomic.AddUint64(&s.truncated, 1)
+			if n&(n-1) == 0 {
+				log.Printf("datagram from %v to %v larger than %d bytes, %d datagrams discarded so far",
+					srcAddr, dst, size, n)
+			}
+			continue
+		}
+
+		if !dst.IsMulticast() {
+			continue
+		}
+		g := s.match(dst, ifIndex)
+		if g == nil {
+			// unknown group, discard
+			continue
+		}
+
+		if handler(buffer, numBytes, g, srcAddr, received) {
+			buffer = nil
+		}
+	}
+}
+
+// readFrom reads a datagram returning the message flags, its destination address, the index of the receiving interface
+// and the receive time
+func (s *socket) readFrom(b []byte) (int, int, net.IP, int, net.Addr, time.Time, error) {
+	n, oobn, flags, src, err := s.conn.ReadMsgUDP(b, s.oob)
+	if err != nil {
+		return n, flags, nil, 0, nil, time.Time{}, err
+	}
+	received := receiveTime(s.oob[:oobn])
+	if received.IsZero() {
+		received = time.Now()
+	}
+
+	if s.ipv6 {
+		var cm ipv6.ControlMessage
+		if err = cm.Parse(s.oob[:oobn]); err != nil {
+			return n, flags, nil, 0, src, received, nil
+		}
+		return n, flags, cm.Dst, cm.IfIndex, src, received, nil
+	}
+	var cm ipv4.ControlMessage
+	if err = cm.Parse(s.oob[:oobn]); err != nil {
+		return n, flags, nil, 0, src, received, nil
+	}
+	return n, flags, cm.Dst, cm.IfIndex, src, received, nil
+}
+
+// match returns the joined group of the datagram, preferring the group joined on the receiving interface
+func (s *socket) match(dst net.IP, ifIndex int) *Group {
+	var found *Group
+	for _, g := range s.groups {
+		if !g.Addr.IP.Equal(dst) {
+			continue
+		}
+		if g.Interface == nil || g.Interface.Index == ifIndex {
+			return g
+		}
+		found = g
+	}
+	return found
+}
+
+// Close leaves all the groups and closes the sockets
+func (l *Listener) Close() {
+	for _, s := range l.sockets {
+		for _, g := range s.groups {
+			s.leaveGroup(g)
+		}
+		s.conn.Close()
+	}
+}
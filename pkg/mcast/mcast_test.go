@@ -0,0 +1,33 @@
+package mcast
+
+import (
+	"testing"
+)
+
+func TestSetSources(t *testing.T) {
+	for _, c := range []struct {
+		group    string
+		sources  []string
+		excluded []string
+		valid    bool
+	}{
+		{"232.1.1.1:10101", []string{"10.1.1.1", "10.1.1.2"}, nil, true},
+		{"[ff35::1]:10101", []string{"2001:db8::1"}, nil, true},
+		{"232.1.1.1:10101", nil, []string{"10.1.1.1"}, true},
+		{"232.1.1.1:10101", []string{"2001:db8::1"}, nil, false},
+		{"232.1.1.1:10101", []string{"10.1.1.1", "2001:db8::1"}, nil, false},
+		{"[ff35::1]:10101", []string{"10.1.1.1"}, nil, false},
+		{"231.1.1.1:10101", nil, []string{"2001:db8::1"}, false},
+		{"232.1.1.1:10101", []string{"10.1.1.1"}, []string{"10.1.1.2"}, false},
+		{"232.1.1.1:10101", []string{"not-an-ip"}, nil, false},
+	} {
+		g, err := ParseGroup(c.group, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = g.SetSources(c.sources, c.excluded)
+		if (err == nil) != c.valid {
+			t.Errorf("group %s, sources %v, excluded %v: error %v", c.group, c.sources, c.excluded, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+//go:build linux
+
+package mcast
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// timestampSpace is the room needed by the receive timestamp control message
+var timestampSpace = syscall.CmsgSpace(int(unsafe.Sizeof(syscall.Timespec{})))
+
+// enableTimestamps asks the kernel to report the receive time of every datagram (SO_TIMESTAMPNS)
+func enableTimestamps(c *net.UDPConn) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// receiveTime returns the kernel receive timestamp found in the control messages, zero if not found
+func receiveTime(oob []byte) time.Time {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_SOCKET || m.Header.Type != syscall.SCM_TIMESTAMPNS {
+			continue
+		}
+		if len(m.Data) < int(unsafe.Sizeof(syscall.Timespec{})) {
+			break
+		}
+		ts := (*syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+		return time.Unix(ts.Unix())
+	}
+	return time.Time{}
+}
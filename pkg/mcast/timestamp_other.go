@@ -0,0 +1,21 @@
+//go:build !linux
+
+package mcast
+
+import (
+	"net"
+	"time"
+)
+
+// timestampSpace is the room needed by the receive timestamp control message
+var timestampSpace = 0
+
+// enableTimestamps is a no-op, kernel receive timestamps are supported on linux only
+func enableTimestamps(c *net.UDPConn) error {
+	return nil
+}
+
+// receiveTime returns zero, the receive time is taken when the datagram is read
+func receiveTime(oob []byte) time.Time {
+	return time.Time{}
+}
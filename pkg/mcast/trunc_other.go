@@ -0,0 +1,6 @@
+//go:build !unix
+
+package mcast
+
+// msgTrunc is not reported, the truncated datagrams are detected by the extra byte of the read buffer
+const msgTrunc = 0
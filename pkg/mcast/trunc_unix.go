@@ -0,0 +1,8 @@
+//go:build unix
+
+package mcast
+
+import "syscall"
+
+// msgTrunc is the flag set by the kernel when the datagram is larger than the read buffer
+const msgTrunc = syscall.MSG_TRUNC
@@ -0,0 +1,108 @@
+package packet
+
+import (
+	"fmt"
+)
+
+/*
+### Packet Type 0x09 = CHALLENGE
+Sent by the server requiring the authentication of the clients, in reply to the client hello. The client proves the
+knowledge of its pre-shared key with a RESPONSE packet, before the server sends the HELLO_ACK.
+
+Nonce: 32 bytes => random bytes generated for the connection
+
+### Packet Type 0x0A = RESPONSE
+Sent by the client in reply to the challenge.
+
+MAC: 32 bytes => HMAC-SHA256 of the string "udptunneler-auth-v1", the nonce and the client ID, with the pre-shared key
+  of the client
+Client Nonce: 32 bytes (optional) => random bytes generated by the client for the connection, required by the
+  encryption. The older clients send the MAC only.
+*/
+
+const (
+	TypeChallenge uint8 = 0x09
+	TypeResponse  uint8 = 0x0A
+)
+
+const (
+	ChallengeNonceLen  = 32
+	ResponseMACLen     = 32
+	ResponseNonceLen   = 32
+	ChallengePacketLen = 1 + ChallengeNonceLen
+	ResponsePacketLen  = 1 + ResponseMACLen
+	// ResponseNoncePacketLen is the length of the response with the client nonce
+	ResponseNoncePacketLen = ResponsePacketLen + ResponseNonceLen
+)
+
+type Challenge struct {
+	Type  uint8
+	Nonce []byte
+}
+
+func (p *Challenge) Decode(buffer []byte) error {
+	if buffer[0] != TypeChallenge {
+		return fmt.Errorf("invalid packet type [%d]", buffer[0])
+	}
+	if len(buffer) != ChallengePacketLen {
+		return fmt.Errorf("invalid challenge length [%d]", len(buffer))
+	}
+	p.Type = TypeChallenge
+	p.Nonce = append([]byte(nil), buffer[1:]...)
+	return nil
+}
+
+func (p *Challenge) Encode(buffer []byte) error {
+	if len(p.Nonce) != ChallengeNonceLen {
+		return fmt.Errorf("invalid challenge nonce length [%d]", len(p.Nonce))
+	}
+	buffer[0] = TypeChallenge
+	copy(buffer[1:], p.Nonce)
+	return nil
+}
+
+func (p *Challenge) Length() int {
+	return ChallengePacketLen
+}
+
+type Response struct {
+	Type  uint8
+	MAC   []byte
+	Nonce []byte // client nonce, nil when not sent
+}
+
+func (p *Response) Decode(buffer []byte) error {
+	if buffer[0] != TypeResponse {
+		return fmt.Errorf("invalid packet type [%d]", buffer[0])
+	}
+	if len(buffer) != ResponsePacketLen && len(buffer) != ResponseNoncePacketLen {
+		return fmt.Errorf("invalid response length [%d]", len(buffer))
+	}
+	p.Type = TypeResponse
+	p.MAC = append([]byte(nil), buffer[1:ResponsePacketLen]...)
+	p.Nonce = nil
+	if len(buffer) == ResponseNoncePacketLen {
+		p.Nonce = append([]byte(nil), buffer[ResponsePacketLen:]...)
+	}
+	return nil
+}
+
+func (p *Response) Encode(buffer []byte) error {
+	if len(p.MAC) != ResponseMACLen {
+		return fmt.Errorf("invalid response mac length [%d]", len(p.MAC))
+	}
+	if p.Nonce != nil && len(p.Nonce) != ResponseNonceLen {
+		return fmt.Errorf("invalid response nonce length [%d]", len(p.Nonce))
+	}
+	buffer[0] = TypeResponse
+	copy(buffer[1:], p.MAC)
+	copy(buffer[ResponsePacketLen:], p.Nonce)
+	return nil
+}
+
+func (p *Response) Length() int {
+	if p.Nonce != nil {
+		return ResponseNoncePacketLen
+	}
+	return ResponsePacketLen
+}
@@ -0,0 +1,178 @@
+package packet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/bytedance/gopkg/lang/mcache"
+	"github.com/mgeri/udptunneler/pkg/frame"
+	"math"
+)
+
+/*
+### Packet Type 0x07 = BATCH
+Packs many datagrams into a single frame, to save the per frame overhead of the high rate streams of small datagrams.
+It is sent only when the batch capability has been negotiated during the handshake.
+
+Count: uint16 => number of datagrams in the batch
+Datagrams: repeated Count times
+  Datagram Length: uint16 => number of bytes of the encoded datagram
+  Datagram: variable []byte => DATAGRAM or DATAGRAM_EXT packet
+*/
+
+const TypeBatch uint8 = 0x07
+
+const (
+	BatchPacketHeaderLen = 1 + 2
+	BatchEntryHeaderLen  = 2
+	MaxBatchEntryLen     = math.MaxUint16
+)
+
+type Batch struct {
+	Type      uint8
+	Datagrams []*Datagram
+}
+
+// Decode decodes the datagrams of the batch, referencing the buffer
+func (p *Batch) Decode(buffer []byte) error {
+	if buffer[0] != TypeBatch {
+		return fmt.Errorf("invalid packet type [%d]", buffer[0])
+	}
+	if len(buffer) < BatchPacketHeaderLen {
+		return fmt.Errorf("invalid batch length [%d]", len(buffer))
+	}
+	p.Type = TypeBatch
+	count := int(binary.LittleEndian.Uint16(buffer[1:3]))
+	p.Datagrams = make([]*Datagram, 0, count)
+	offset := BatchPacketHeaderLen
+	for i := 0; i < count; i++ {
+		if len(buffer) < offset+BatchEntryHeaderLen {
+			return fmt.Errorf("invalid batch length [%d] for [%d] datagrams", len(buffer), count)
+		}
+		l := int(binary.LittleEndian.Uint16(buffer[offset : offset+BatchEntryHeaderLen]))
+		offset += BatchEntryHeaderLen
+		if l == 0 || len(buffer) < offset+l {
+			return fmt.Errorf("invalid batch datagram length [%d]", l)
+		}
+		d := &Datagram{}
+		if err := d.Decode(buffer[offset : offset+l]); err != nil {
+			return err
+		}
+		p.Datagrams = append(p.Datagrams, d)
+		offset += l
+	}
+	if offset != len(buffer) {
+		return fmt.Errorf("invalid batch length [%d], expected [%d]", len(buffer), offset)
+	}
+	return nil
+}
+
+func (p *Batch) Encode(buffer []byte) error {
+	buffer[0] = TypeBatch
+	binary.LittleEndian.PutUint16(buffer[1:3], uint16(len(p.Datagrams)))
+	offset := BatchPacketHeaderLen
+	for _, d := range p.Datagrams {
+		l := d.Length()
+		binary.LittleEndian.PutUint16(buffer[offset:offset+BatchEntryHeaderLen], uint16(l))
+		offset += BatchEntryHeaderLen
+		if err := d.Encode(buffer[offset : offset+l]); err != nil {
+			return err
+		}
+		offset += l
+	}
+	return nil
+}
+
+func (p *Batch) Length() int {
+	l := BatchPacketHeaderLen
+	for _, d := range p.Datagrams {
+		l += BatchEntryHeaderLen + d.Length()
+	}
+	return l
+}
+
+// BatchWriter packs the datagrams into batch frames, written to the outbound stream when full by size or by count,
+// or when flushed.
+type BatchWriter struct {
+	codec    frame.StreamFrameCodec
+	w        *bufio.Writer
+	maxCount int
+	buffer   []byte // batch being filled
+	length   int    // bytes used in the buffer
+	count    int    // datagrams in the buffer
+}
+
+// NewBatchWriter creates a writer of batches of at most maxSize bytes and maxCount datagrams
+func NewBatchWriter(codec frame.StreamFrameCodec, w *bufio.Writer, maxSize int, maxCount int) *BatchWriter {
+	return &BatchWriter{
+		codec:    codec,
+		w:        w,
+		maxCount: maxCount,
+		buffer:   mcache.Malloc(maxSize),
+		length:   BatchPacketHeaderLen,
+	}
+}
+
+// Add encodes the datagram in the batch, flushing the batch first if the datagram does not fit, and after if the batch
+// is full. The datagram payload is expected at offset MaxDatagramPacketHeaderLen of the DatagramPacket buffer,
+// as for WriteDatagram. The buffer is released once added.
+// A datagram larger than an empty batch is written in its own frame, right after the pending datagrams.
+func (b *BatchWriter) Add(d *Datagram) error {
+	l := d.Length()
+	if l > MaxBatchEntryLen || BatchPacketHeaderLen+BatchEntryHeaderLen+l > len(b.buffer) {
+		if err := b.Flush(); err != nil {
+			mcache.Free(d.DatagramPacket)
+			return err
+		}
+		return WriteDatagram(b.codec, b.w, d)
+	}
+
+	buffer := d.DatagramPacket
+	defer mcache.Free(buffer)
+	d.DatagramPacket = buffer[MaxDatagramPacketHeaderLen : MaxDatagramPacketHeaderLen+int(d.DatagramLength)]
+
+	if b.length+BatchEntryHeaderLen+l > len(b.buffer) {
+		if err := b.Flush(); err != nil {
+			return err
+		}
+	}
+	binary.LittleEndian.PutUint16(b.buffer[b.length:b.length+BatchEntryHeaderLen], uint16(l))
+	b.length += BatchEntryHeaderLen
+	if err := d.Encode(b.buffer[b.length : b.length+l]); err != nil {
+		return err
+	}
+	b.length += l
+	b.count++
+
+	if b.count >= b.maxCount {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Len returns the number of datagrams waiting to be flushed
+func (b *BatchWriter) Len() int {
+	return b.count
+}
+
+// Flush writes the pending datagrams as a single frame and flushes the outbound stream
+func (b *BatchWriter) Flush() error {
+	if b.count == 0 {
+		return nil
+	}
+	b.buffer[0] = TypeBatch
+	binary.LittleEndian.PutUint16(b.buffer[1:3], uint16(b.count))
+	err := b.codec.Encode(b.w, b.buffer[:b.length])
+	b.length = BatchPacketHeaderLen
+	b.count = 0
+	if err != nil {
+		return err
+	}
+	return b.w.Flush()
+}
+
+// Release releases the batch buffer, discarding the pending datagrams
+func (b *BatchWriter) Release() {
+	mcache.Free(b.buffer)
+	b.buffer = nil
+}
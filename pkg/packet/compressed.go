@@ -0,0 +1,60 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+### Packet Type 0x08 = COMPRESSED
+Carries the compressed payload of a frame, decompressed into a single packet (e.g. a DATAGRAM or a BATCH).
+It is sent only when the compression capability has been negotiated during the handshake, and only when the
+compressed payload is smaller than the original one.
+
+Algorithm: uint8 => compression algorithm (1 = zstd)
+Original Length: uint32 => number of bytes of the decompressed packet
+Data: variable []byte => compressed packet
+*/
+
+const TypeCompressed uint8 = 0x08
+
+const CompressedPacketHeaderLen = 1 + 1 + 4
+
+// Compression algorithms
+const (
+	CompressionZstd uint8 = 1
+)
+
+type Compressed struct {
+	Type           uint8
+	Algorithm      uint8
+	OriginalLength uint32
+	Data           []byte
+}
+
+// Decode decodes the compressed packet, referencing the buffer
+func (p *Compressed) Decode(buffer []byte) error {
+	if buffer[0] != TypeCompressed {
+		return fmt.Errorf("invalid packet type [%d]", buffer[0])
+	}
+	if len(buffer) < CompressedPacketHeaderLen {
+		return fmt.Errorf("invalid compressed length [%d]", len(buffer))
+	}
+	p.Type = TypeCompressed
+	p.Algorithm = buffer[1]
+	p.OriginalLength = binary.LittleEndian.Uint32(buffer[2:6])
+	p.Data = buffer[CompressedPacketHeaderLen:]
+	return nil
+}
+
+func (p *Compressed) Encode(buffer []byte) error {
+	buffer[0] = TypeCompressed
+	buffer[1] = p.Algorithm
+	binary.LittleEndian.PutUint32(buffer[2:6], p.OriginalLength)
+	copy(buffer[CompressedPacketHeaderLen:], p.Data)
+	return nil
+}
+
+func (p *Compressed) Length() int {
+	return CompressedPacketHeaderLen + len(p.Data)
+}
@@ -0,0 +1,197 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+### Packet Type 0x03 = HELLO
+First packet sent by the client right after the connection is established. No datagram is accepted by the server
+before the handshake is completed.
+
+Protocol Version: uint16 => highest protocol version supported by the client
+Capabilities: uint32 => bitmap of the optional features supported by the client
+Client ID Length: uint8 => number of bytes of the client ID
+Client ID: variable []byte => name of the client, used for logging
+
+The handshake packets are always sent with the uint16 frame length. From protocol version 2, the packets following
+the handshake are sent with the uint32 frame length.
+
+### Packet Type 0x04 = HELLO_ACK
+Sent by the server when the client hello has been accepted, and the client authenticated if required.
+
+Protocol Version: uint16 => protocol version used on the connection
+Capabilities: uint32 => bitmap of the optional features enabled on the connection (supported by both ends)
+
+### Packet Type 0x05 = ERROR
+Sent by the server when it refuses the client. The server closes the connection right after.
+
+Error Code: uint16 => reason of the refusal
+Message Length: uint16 => number of bytes of the message
+Message: variable []byte => human-readable description of the error
+*/
+
+const (
+	TypeHello    uint8 = 0x03
+	TypeHelloAck uint8 = 0x04
+	TypeError    uint8 = 0x05
+)
+
+const (
+	HelloPacketHeaderLen    = 1 + 2 + 4 + 1
+	HelloAckPacketHeaderLen = 1 + 2 + 4
+	ErrorPacketHeaderLen    = 1 + 2 + 2
+)
+
+const (
+	// ProtocolVersion is the highest protocol version implemented
+	ProtocolVersion uint16 = 2
+	// MinProtocolVersion is the lowest protocol version still accepted from a peer
+	MinProtocolVersion uint16 = 1
+
+	// LargeFramesVersion is the first protocol version using the large frames after the handshake
+	LargeFramesVersion uint16 = 2
+
+	MaxClientIDLen = 255
+)
+
+// Capabilities bitmap exchanged during the handshake
+const (
+	// CapCompression is requested by the client when enabled, trading CPU for bandwidth
+	CapCompression uint32 = 1 << iota
+	CapIPv6
+	CapSequence
+	CapSourceAddress
+	// CapReverse is requested by the client to receive the datagrams of the channels joined by the server.
+	// It is granted only by servers joining channels, it is not part of SupportedCapabilities.
+	CapReverse
+	CapTimestamp
+	CapBatch
+	// CapEncryption is requested by the client when enabled, it is granted only to the clients authenticated with a
+	// pre-shared key, the frames following the handshake are then encrypted (see the encrypt package)
+	CapEncryption
+)
+
+// SupportedCapabilities is the set of capabilities implemented by this build
+const SupportedCapabilities = CapCompression | CapIPv6 | CapSequence | CapSourceAddress | CapTimestamp | CapBatch |
+	CapEncryption
+
+// Error codes carried by the Error packet
+const (
+	ErrorCodeUnsupportedVersion uint16 = 1 + iota
+	ErrorCodeHandshakeRequired
+	ErrorCodeBadRequest
+	ErrorCodeUnauthorized
+)
+
+type Hello struct {
+	Type         uint8
+	Version      uint16
+	Capabilities uint32
+	ClientID     string
+}
+
+func (p *Hello) Decode(buffer []byte) error {
+	if buffer[0] != TypeHello {
+		return fmt.Errorf("invalid packet type [%d]", buffer[0])
+	}
+	if len(buffer) < HelloPacketHeaderLen {
+		return fmt.Errorf("invalid hello length [%d]", len(buffer))
+	}
+	idLen := int(buffer[7])
+	if len(buffer) != HelloPacketHeaderLen+idLen {
+		return fmt.Errorf("invalid hello client id length [%d]", idLen)
+	}
+	p.Type = TypeHello
+	p.Version = binary.LittleEndian.Uint16(buffer[1:3])
+	p.Capabilities = binary.LittleEndian.Uint32(buffer[3:7])
+	p.ClientID = string(buffer[HelloPacketHeaderLen:])
+	return nil
+}
+
+func (p *Hello) Encode(buffer []byte) error {
+	if len(p.ClientID) > MaxClientIDLen {
+		return fmt.Errorf("invalid client id length [%d], max [%d]", len(p.ClientID), MaxClientIDLen)
+	}
+	buffer[0] = TypeHello
+	binary.LittleEndian.PutUint16(buffer[1:3], p.Version)
+	binary.LittleEndian.PutUint32(buffer[3:7], p.Capabilities)
+	buffer[7] = uint8(len(p.ClientID))
+	copy(buffer[HelloPacketHeaderLen:], p.ClientID)
+	return nil
+}
+
+func (p *Hello) Length() int {
+	return HelloPacketHeaderLen + len(p.ClientID)
+}
+
+type HelloAck struct {
+	Type         uint8
+	Version      uint16
+	Capabilities uint32
+}
+
+func (p *HelloAck) Decode(buffer []byte) error {
+	if buffer[0] != TypeHelloAck {
+		return fmt.Errorf("invalid packet type [%d]", buffer[0])
+	}
+	if len(buffer) != HelloAckPacketHeaderLen {
+		return fmt.Errorf("invalid hello ack length [%d]", len(buffer))
+	}
+	p.Type = TypeHelloAck
+	p.Version = binary.LittleEndian.Uint16(buffer[1:3])
+	p.Capabilities = binary.LittleEndian.Uint32(buffer[3:7])
+	return nil
+}
+
+func (p *HelloAck) Encode(buffer []byte) error {
+	buffer[0] = TypeHelloAck
+	binary.LittleEndian.PutUint16(buffer[1:3], p.Version)
+	binary.LittleEndian.PutUint32(buffer[3:7], p.Capabilities)
+	return nil
+}
+
+func (p *HelloAck) Length() int {
+	return HelloAckPacketHeaderLen
+}
+
+type Error struct {
+	Type    uint8
+	Code    uint16
+	Message string
+}
+
+func (p *Error) Decode(buffer []byte) error {
+	if buffer[0] != TypeError {
+		return fmt.Errorf("invalid packet type [%d]", buffer[0])
+	}
+	if len(buffer) < ErrorPacketHeaderLen {
+		return fmt.Errorf("invalid error length [%d]", len(buffer))
+	}
+	msgLen := int(binary.LittleEndian.Uint16(buffer[3:5]))
+	if len(buffer) != ErrorPacketHeaderLen+msgLen {
+		return fmt.Errorf("invalid error message length [%d]", msgLen)
+	}
+	p.Type = TypeError
+	p.Code = binary.LittleEndian.Uint16(buffer[1:3])
+	p.Message = string(buffer[ErrorPacketHeaderLen:])
+	return nil
+}
+
+func (p *Error) Encode(buffer []byte) error {
+	buffer[0] = TypeError
+	binary.LittleEndian.PutUint16(buffer[1:3], p.Code)
+	binary.LittleEndian.PutUint16(buffer[3:5], uint16(len(p.Message)))
+	copy(buffer[ErrorPacketHeaderLen:], p.Message)
+	return nil
+}
+
+func (p *Error) Length() int {
+	return ErrorPacketHeaderLen + len(p.Message)
+}
+
+// Error allows an Error packet received from the peer to be returned as a go error
+func (p *Error) Error() string {
+	return fmt.Sprintf("peer error [%d]: %s", p.Code, p.Message)
+}
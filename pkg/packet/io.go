@@ -0,0 +1,59 @@
+package packet
+
+import (
+	"bufio"
+	"github.com/bytedance/gopkg/lang/mcache"
+	"github.com/mgeri/udptunneler/pkg/frame"
+)
+
+// WriteFrame encodes the packet into a single frame and flushes it to the outbound stream
+func WriteFrame(codec frame.StreamFrameCodec, w *bufio.Writer, p Packet) error {
+	buf := mcache.Malloc(p.Length())
+	defer mcache.Free(buf)
+
+	err := p.Encode(buf)
+	if err != nil {
+		return err
+	}
+	err = codec.Encode(w, buf)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// WriteDatagram encodes the datagram into a single frame and flushes it to the outbound stream.
+// The datagram payload is expected at offset MaxDatagramPacketHeaderLen of the DatagramPacket buffer, so that the
+// header is encoded in place without copying the payload. The buffer is released once written.
+func WriteDatagram(codec frame.StreamFrameCodec, w *bufio.Writer, d *Datagram) error {
+	buffer := d.DatagramPacket
+	defer mcache.Free(buffer)
+
+	d.DatagramPacket = nil
+	offset := MaxDatagramPacketHeaderLen - d.HeaderLength()
+	err := d.Encode(buffer[offset:])
+	if err != nil {
+		return err
+	}
+	err = codec.Encode(w, buffer[offset:offset+d.Length()])
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// ReadFrame reads a single frame from the inbound stream and decodes the packet it contains.
+// The returned frame payload is referenced by the packet and must be released with mcache.Free once the packet
+// is no longer used.
+func ReadFrame(codec frame.StreamFrameCodec, r *bufio.Reader) (Packet, frame.FramePayload, error) {
+	framePayload, err := codec.Decode(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := Decode(framePayload)
+	if err != nil {
+		mcache.Free(framePayload)
+		return nil, nil, err
+	}
+	return p, framePayload, nil
+}
@@ -14,24 +14,59 @@ Type: uint8 => type of the packet (0x00 = HEARTBEAT, 0x01 = DATAGRAM)
 
 ### Packet Type 0x00 = HEARTBEAT
 This type of packet has no payload. It is sent by the client to the server and helps ensure both ends of the connection know if the other end is alive.
+The server echoes every heartbeat back to the client. When the timestamp capability has been negotiated the heartbeat
+carries the following payload, used to measure the round trip time and the clock offset between the client and the server:
+
+Timestamp: int64 => send time of the heartbeat, in nanoseconds since the unix epoch (client clock)
+Round Trip Time: int64 => last round trip time measured by the client, in nanoseconds (0 if not measured yet)
+Heartbeat Interval: uint32 => interval between the heartbeats sent by the client, in milliseconds
+Heartbeat Timeout: uint32 => time without any packet after which the peer is considered dead, in milliseconds
 
 ### Packet Type 0x01 = DATAGRAM
-This packet encapsulates the datagram observed by the client. Here is its complete description:
+This packet encapsulates the datagram observed by the client (or by the server, in reverse mode). Here is its complete description:
 
 Datagram Length: uint16 => number of bytes of the datagram packet
 UDP Channel Address: uint32 => destination address of the multicast group which the client joined to receive that datagram
 UDP Channel: Port uint16 => destination port of the multicast group which the client joined to receive that datagram
 Datagram Packet: variable []byte => actual datagram received by the client from the multicast channel
+
+### Packet Type 0x06 = DATAGRAM_EXT
+Extended version of the DATAGRAM packet, carrying optional fields announced by the flags. It is sent only when
+the capabilities of the optional fields have been negotiated during the handshake.
+
+Flags: uint8 => bitmap of the optional fields present in the packet (0x01 = SOURCE, 0x02 = IPV6, 0x04 = SEQUENCE, 0x08 = TIMESTAMP)
+Datagram Length: uint16 => number of bytes of the datagram packet
+UDP Channel Address: uint32, or [16]byte with IPV6 flag => destination address of the multicast group which the client joined to receive that datagram
+UDP Channel: Port uint16 => destination port of the multicast group which the client joined to receive that datagram
+Source Address: uint32, or [16]byte with IPV6 flag (SOURCE flag) => address of the host which published the datagram
+Source Port: uint16 (SOURCE flag) => port of the host which published the datagram
+Sequence Number: uint32 (SEQUENCE flag) => number of the datagram in the stream of its multicast group, incremented by one for every datagram received by the client
+Timestamp: int64 (TIMESTAMP flag) => receive time of the datagram, in nanoseconds since the unix epoch (client clock)
+Datagram Packet: variable []byte => actual datagram received by the client from the multicast channel
 */
 
 const (
-	TypeHeartbeat uint8 = 0x01
-	TypeDatagram  uint8 = 0x02
+	TypeHeartbeat   uint8 = 0x01
+	TypeDatagram    uint8 = 0x02
+	TypeDatagramExt uint8 = 0x06
 )
 
 const (
-	HeartbeatPacketHeaderLen = 1
-	DatagramPacketHeaderLen  = 1 + 2 + 4 + 2
+	HeartbeatPacketHeaderLen   = 1
+	HeartbeatExtPacketLen      = 1 + 8 + 8 + 4 + 4
+	DatagramPacketHeaderLen    = 1 + 2 + 4 + 2
+	DatagramExtPacketHeaderLen = 1 + 1 + 2 + 4 + 2
+
+	// MaxDatagramPacketHeaderLen is the longest datagram header, with all the optional fields
+	MaxDatagramPacketHeaderLen = DatagramExtPacketHeaderLen + (net.IPv6len - net.IPv4len) + net.IPv6len + 2 + 4 + 8
+)
+
+// Flags of the optional fields of the extended datagram packet
+const (
+	DatagramFlagSource uint8 = 1 << iota
+	DatagramFlagIPv6
+	DatagramFlagSequence
+	DatagramFlagTimestamp
 )
 
 type Packet interface {
@@ -41,7 +76,11 @@ type Packet interface {
 }
 
 type Heartbeat struct {
-	Type uint8
+	Type      uint8
+	Timestamp int64  // CapTimestamp only, the payload is sent when not zero
+	RTT       int64  // CapTimestamp only
+	Interval  uint32 // CapTimestamp only, milliseconds
+	Timeout   uint32 // CapTimestamp only, milliseconds
 }
 
 func (p *Heartbeat) Decode(buffer []byte) error {
@@ -49,35 +88,136 @@ func (p *Heartbeat) Decode(buffer []byte) error {
 		return fmt.Errorf("invalid packet type [%d]", buffer[0])
 	}
 	p.Type = TypeHeartbeat
+	p.Timestamp = 0
+	p.RTT = 0
+	p.Interval = 0
+	p.Timeout = 0
+	if len(buffer) >= HeartbeatExtPacketLen {
+		p.Timestamp = int64(binary.LittleEndian.Uint64(buffer[1:9]))
+		p.RTT = int64(binary.LittleEndian.Uint64(buffer[9:17]))
+		p.Interval = binary.LittleEndian.Uint32(buffer[17:21])
+		p.Timeout = binary.LittleEndian.Uint32(buffer[21:25])
+	}
 	return nil
 }
 
 func (p *Heartbeat) Encode(buffer []byte) error {
 	buffer[0] = TypeHeartbeat
+	if p.Timestamp != 0 {
+		binary.LittleEndian.PutUint64(buffer[1:9], uint64(p.Timestamp))
+		binary.LittleEndian.PutUint64(buffer[9:17], uint64(p.RTT))
+		binary.LittleEndian.PutUint32(buffer[17:21], p.Interval)
+		binary.LittleEndian.PutUint32(buffer[21:25], p.Timeout)
+	}
 	return nil
 }
 
 func (p *Heartbeat) Length() int {
+	if p.Timestamp != 0 {
+		return HeartbeatExtPacketLen
+	}
 	return HeartbeatPacketHeaderLen
 }
 
 type Datagram struct {
 	Type           uint8
+	Flags          uint8
 	DatagramLength uint16
 	UdpIP          net.IP
 	UdpPort        uint16
+	SrcIP          net.IP // DatagramFlagSource only
+	SrcPort        uint16 // DatagramFlagSource only
+	Sequence       uint32 // DatagramFlagSequence only
+	Timestamp      int64  // DatagramFlagTimestamp only
 	DatagramPacket []byte
 }
 
+// Source returns the address of the host which published the datagram, or nil when not provided by the client
+func (p *Datagram) Source() *net.UDPAddr {
+	if p.Flags&DatagramFlagSource == 0 || p.SrcIP == nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: p.SrcIP, Port: int(p.SrcPort)}
+}
+
+// SetAddressFamily sets the DatagramFlagIPv6 flag when the group or the source addresses are not IPv4 addresses
+func (p *Datagram) SetAddressFamily() {
+	p.Flags &^= DatagramFlagIPv6
+	if p.UdpIP.To4() == nil || (p.Flags&DatagramFlagSource != 0 && p.SrcIP.To4() == nil) {
+		p.Flags |= DatagramFlagIPv6
+	}
+}
+
+// Negotiate sets the optional fields allowed by the capabilities negotiated with the peer, and clears the others.
+// It returns false when the datagram can not be sent to the peer.
+func (p *Datagram) Negotiate(capabilities uint32) bool {
+	if capabilities&CapSourceAddress != 0 && p.SrcIP != nil {
+		p.Flags |= DatagramFlagSource
+	}
+	if capabilities&CapSequence == 0 {
+		p.Flags &^= DatagramFlagSequence
+	}
+	if capabilities&CapTimestamp == 0 {
+		p.Flags &^= DatagramFlagTimestamp
+	}
+	p.SetAddressFamily()
+	return p.Flags&DatagramFlagIPv6 == 0 || capabilities&CapIPv6 != 0
+}
+
+func (p *Datagram) addrLen() int {
+	if p.Flags&DatagramFlagIPv6 != 0 {
+		return net.IPv6len
+	}
+	return net.IPv4len
+}
+
 func (p *Datagram) Decode(buffer []byte) error {
-	if buffer[0] != TypeDatagram {
+	switch buffer[0] {
+	case TypeDatagram:
+		if len(buffer) < DatagramPacketHeaderLen {
+			return fmt.Errorf("invalid datagram length [%d]", len(buffer))
+		}
+		p.Type = TypeDatagram
+		p.Flags = 0
+		p.DatagramLength = binary.LittleEndian.Uint16(buffer[1:3])
+		p.UdpIP = net.IPv4(buffer[3], buffer[4], buffer[5], buffer[6])
+		p.UdpPort = binary.LittleEndian.Uint16(buffer[7:9])
+	case TypeDatagramExt:
+		if len(buffer) < DatagramExtPacketHeaderLen {
+			return fmt.Errorf("invalid datagram length [%d]", len(buffer))
+		}
+		p.Type = TypeDatagramExt
+		p.Flags = buffer[1]
+		if len(buffer) < p.HeaderLength() {
+			return fmt.Errorf("invalid datagram length [%d] for flags [%#x]", len(buffer), p.Flags)
+		}
+		p.DatagramLength = binary.LittleEndian.Uint16(buffer[2:4])
+		offset := 4
+		addrLen := p.addrLen()
+		p.UdpIP = decodeIP(buffer[offset : offset+addrLen])
+		offset += addrLen
+		p.UdpPort = binary.LittleEndian.Uint16(buffer[offset : offset+2])
+		offset += 2
+		if p.Flags&DatagramFlagSource != 0 {
+			p.SrcIP = decodeIP(buffer[offset : offset+addrLen])
+			offset += addrLen
+			p.SrcPort = binary.LittleEndian.Uint16(buffer[offset : offset+2])
+			offset += 2
+		}
+		if p.Flags&DatagramFlagSequence != 0 {
+			p.Sequence = binary.LittleEndian.Uint32(buffer[offset : offset+4])
+			offset += 4
+		}
+		if p.Flags&DatagramFlagTimestamp != 0 {
+			p.Timestamp = int64(binary.LittleEndian.Uint64(buffer[offset : offset+8]))
+		}
+	default:
 		return fmt.Errorf("invalid packet type [%d]", buffer[0])
 	}
-	p.Type = TypeDatagram
-	p.DatagramLength = binary.LittleEndian.Uint16(buffer[1:3])
-	p.UdpIP = net.IPv4(buffer[3], buffer[4], buffer[5], buffer[6])
-	p.UdpPort = binary.LittleEndian.Uint16(buffer[7:9])
-	p.DatagramPacket = buffer[9:]
+	p.DatagramPacket = buffer[p.HeaderLength():]
+	if len(p.DatagramPacket) != int(p.DatagramLength) {
+		return fmt.Errorf("invalid datagram length [%d], expected [%d]", len(p.DatagramPacket), p.DatagramLength)
+	}
 	return nil
 }
 
@@ -87,21 +227,85 @@ func (p *Datagram) Encode(buffer []byte) error {
 			return fmt.Errorf("invalid datagram length [%d], expected [%d]", len(p.DatagramPacket), p.DatagramLength)
 		}
 	}
-	buffer[0] = TypeDatagram
-	binary.LittleEndian.PutUint16(buffer[1:3], p.DatagramLength)
-	copy(buffer[3:7], p.UdpIP.To4())
-	binary.LittleEndian.PutUint16(buffer[7:9], p.UdpPort)
+	if p.Flags == 0 {
+		buffer[0] = TypeDatagram
+		binary.LittleEndian.PutUint16(buffer[1:3], p.DatagramLength)
+		copy(buffer[3:7], p.UdpIP.To4())
+		binary.LittleEndian.PutUint16(buffer[7:9], p.UdpPort)
+	} else {
+		buffer[0] = TypeDatagramExt
+		buffer[1] = p.Flags
+		binary.LittleEndian.PutUint16(buffer[2:4], p.DatagramLength)
+		offset := 4
+		addrLen := p.addrLen()
+		encodeIP(buffer[offset:offset+addrLen], p.UdpIP)
+		offset += addrLen
+		binary.LittleEndian.PutUint16(buffer[offset:offset+2], p.UdpPort)
+		offset += 2
+		if p.Flags&DatagramFlagSource != 0 {
+			encodeIP(buffer[offset:offset+addrLen], p.SrcIP)
+			offset += addrLen
+			binary.LittleEndian.PutUint16(buffer[offset:offset+2], p.SrcPort)
+			offset += 2
+		}
+		if p.Flags&DatagramFlagSequence != 0 {
+			binary.LittleEndian.PutUint32(buffer[offset:offset+4], p.Sequence)
+			offset += 4
+		}
+		if p.Flags&DatagramFlagTimestamp != 0 {
+			binary.LittleEndian.PutUint64(buffer[offset:offset+8], uint64(p.Timestamp))
+		}
+	}
 	if (p.DatagramPacket != nil) && (len(p.DatagramPacket) > 0) {
-		copy(buffer[DatagramPacketHeaderLen:], p.DatagramPacket)
+		copy(buffer[p.HeaderLength():], p.DatagramPacket)
 	}
 	return nil
 }
 
 func (p *Datagram) Length() int {
-	return DatagramPacketHeaderLen + int(p.DatagramLength)
+	return p.HeaderLength() + int(p.DatagramLength)
+}
+
+// HeaderLength returns the length of the datagram header, depending on the optional fields
+func (p *Datagram) HeaderLength() int {
+	if p.Flags == 0 {
+		return DatagramPacketHeaderLen
+	}
+	addrLen := p.addrLen()
+	l := DatagramExtPacketHeaderLen + addrLen - net.IPv4len
+	if p.Flags&DatagramFlagSource != 0 {
+		l += addrLen + 2
+	}
+	if p.Flags&DatagramFlagSequence != 0 {
+		l += 4
+	}
+	if p.Flags&DatagramFlagTimestamp != 0 {
+		l += 8
+	}
+	return l
+}
+
+func decodeIP(buffer []byte) net.IP {
+	if len(buffer) == net.IPv4len {
+		return net.IPv4(buffer[0], buffer[1], buffer[2], buffer[3])
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, buffer)
+	return ip
+}
+
+func encodeIP(buffer []byte, ip net.IP) {
+	if len(buffer) == net.IPv4len {
+		copy(buffer, ip.To4())
+	} else {
+		copy(buffer, ip.To16())
+	}
 }
 
 func Decode(buffer []byte) (Packet, error) {
+	if len(buffer) == 0 {
+		return nil, fmt.Errorf("empty packet")
+	}
 	pktType := buffer[0]
 
 	switch pktType {
@@ -112,13 +316,62 @@ func Decode(buffer []byte) (Packet, error) {
 			return nil, err
 		}
 		return &p, nil
-	case TypeDatagram:
+	case TypeDatagram, TypeDatagramExt:
 		p := Datagram{}
 		err := p.Decode(buffer)
 		if err != nil {
 			return nil, err
 		}
 		return &p, nil
+	case TypeBatch:
+		p := Batch{}
+		err := p.Decode(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return &p, nil
+	case TypeCompressed:
+		p := Compressed{}
+		err := p.Decode(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return &p, nil
+	case TypeChallenge:
+		p := Challenge{}
+		err := p.Decode(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return &p, nil
+	case TypeResponse:
+		p := Response{}
+		err := p.Decode(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return &p, nil
+	case TypeHello:
+		p := Hello{}
+		err := p.Decode(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return &p, nil
+	case TypeHelloAck:
+		p := HelloAck{}
+		err := p.Decode(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return &p, nil
+	case TypeError:
+		p := Error{}
+		err := p.Decode(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return &p, nil
 	default:
 		return nil, fmt.Errorf("unknown packet type [%d]", pktType)
 	}
@@ -0,0 +1,245 @@
+package packet
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/bytedance/gopkg/lang/mcache"
+	"github.com/mgeri/udptunneler/pkg/frame"
+	"net"
+	"testing"
+)
+
+// datagram returns a datagram of the given flags and payload
+func datagram(flags uint8, payload string) *Datagram {
+	d := &Datagram{
+		Flags:          flags,
+		DatagramLength: uint16(len(payload)),
+		UdpIP:          net.ParseIP("232.1.1.1"),
+		UdpPort:        10101,
+		DatagramPacket: []byte(payload),
+	}
+	if flags&DatagramFlagIPv6 != 0 {
+		d.UdpIP = net.ParseIP("ff35::1")
+	}
+	if flags&DatagramFlagSource != 0 {
+		d.SrcIP = net.ParseIP("10.1.1.1")
+		if flags&DatagramFlagIPv6 != 0 {
+			d.SrcIP = net.ParseIP("2001:db8::1")
+		}
+		d.SrcPort = 20202
+	}
+	if flags&DatagramFlagSequence != 0 {
+		d.Sequence = 0xdeadbeef
+	}
+	if flags&DatagramFlagTimestamp != 0 {
+		d.Timestamp = 1700000000123456789
+	}
+	return d
+}
+
+// encode returns the encoded packet
+func encode(t *testing.T, p Packet) []byte {
+	t.Helper()
+	buffer := make([]byte, p.Length())
+	if err := p.Encode(buffer); err != nil {
+		t.Fatal(err)
+	}
+	return buffer
+}
+
+// checkDatagram fails when the decoded datagram differs from the expected one
+func checkDatagram(t *testing.T, name string, got *Datagram, expected *Datagram) {
+	t.Helper()
+	if got.Flags != expected.Flags || got.DatagramLength != expected.DatagramLength ||
+		!got.UdpIP.Equal(expected.UdpIP) || got.UdpPort != expected.UdpPort ||
+		!bytes.Equal(got.DatagramPacket, expected.DatagramPacket) {
+		t.Fatalf("%s: decoded %+v, expected %+v", name, got, expected)
+	}
+	if expected.Flags&DatagramFlagSource != 0 && (!got.SrcIP.Equal(expected.SrcIP) || got.SrcPort != expected.SrcPort) {
+		t.Fatalf("%s: source %s, expected %s", name, got.Source(), expected.Source())
+	}
+	if got.Sequence != expected.Sequence || got.Timestamp != expected.Timestamp {
+		t.Fatalf("%s: sequence %d timestamp %d, expected %d %d", name, got.Sequence, got.Timestamp,
+			expected.Sequence, expected.Timestamp)
+	}
+}
+
+var datagramFlags = []struct {
+	name  string
+	flags uint8
+}{
+	{"datagram", 0},
+	{"source", DatagramFlagSource},
+	{"ipv6", DatagramFlagIPv6},
+	{"ipv6 source", DatagramFlagIPv6 | DatagramFlagSource},
+	{"sequence", DatagramFlagSequence},
+	{"timestamp", DatagramFlagTimestamp},
+	{"all", DatagramFlagSource | DatagramFlagIPv6 | DatagramFlagSequence | DatagramFlagTimestamp},
+}
+
+func TestDatagramRoundTrip(t *testing.T) {
+	for _, c := range datagramFlags {
+		for _, payload := range []string{"", "payload"} {
+			d := datagram(c.flags, payload)
+			b := encode(t, d)
+			if len(b) > MaxDatagramPacketHeaderLen+len(payload) {
+				t.Fatalf("%s: header length [%d] over the max", c.name, len(b)-len(payload))
+			}
+			expectedType := TypeDatagramExt
+			if c.flags == 0 {
+				expectedType = TypeDatagram
+			}
+			if b[0] != expectedType {
+				t.Fatalf("%s: packet type [%d], expected [%d]", c.name, b[0], expectedType)
+			}
+			p, err := Decode(b)
+			if err != nil {
+				t.Fatalf("%s: %s", c.name, err)
+			}
+			checkDatagram(t, c.name, p.(*Datagram), d)
+		}
+	}
+}
+
+func TestDatagramTruncated(t *testing.T) {
+	for _, c := range datagramFlags {
+		d := datagram(c.flags, "payload")
+		b := encode(t, d)
+		for _, l := range []int{1, d.HeaderLength() - 1, d.HeaderLength(), len(b) - 1} {
+			if _, err := Decode(b[:l]); err == nil {
+				t.Fatalf("%s: datagram truncated to [%d] bytes decoded", c.name, l)
+			}
+		}
+		if _, err := Decode(append(b, 0)); err == nil {
+			t.Fatalf("%s: datagram with a trailing byte decoded", c.name)
+		}
+	}
+}
+
+func TestDatagramFlagsBeyondBuffer(t *testing.T) {
+	// flags announcing fields not sent
+	b := encode(t, datagram(DatagramFlagSequence, ""))
+	b[1] |= DatagramFlagIPv6 | DatagramFlagSource | DatagramFlagTimestamp
+	if _, err := Decode(b); err == nil {
+		t.Fatal("datagram with fields missing decoded")
+	}
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	for _, datagrams := range [][]*Datagram{
+		{},
+		{datagram(0, "first")},
+		{datagram(0, "first"), datagram(DatagramFlagSequence, ""), datagram(DatagramFlagIPv6|DatagramFlagSource, "third")},
+	} {
+		b := encode(t, &Batch{Datagrams: datagrams})
+		p, err := Decode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch := p.(*Batch)
+		if len(batch.Datagrams) != len(datagrams) {
+			t.Fatalf("[%d] datagrams decoded, expected [%d]", len(batch.Datagrams), len(datagrams))
+		}
+		for i, d := range datagrams {
+			checkDatagram(t, "batch", batch.Datagrams[i], d)
+		}
+	}
+}
+
+func TestBatchInvalid(t *testing.T) {
+	batch := encode(t, &Batch{Datagrams: []*Datagram{datagram(0, "first"), datagram(DatagramFlagSequence, "second")}})
+	first := datagram(0, "first").Length()
+
+	for _, c := range []struct {
+		name  string
+		input []byte
+	}{
+		{"truncated header", batch[:BatchPacketHeaderLen-1]},
+		{"missing datagrams", batch[:BatchPacketHeaderLen]},
+		{"truncated entry header", batch[:BatchPacketHeaderLen+BatchEntryHeaderLen+first+1]},
+		{"truncated datagram", batch[:len(batch)-1]},
+		{"trailing bytes", append(append([]byte(nil), batch...), 0)},
+		{"empty datagram", []byte{TypeBatch, 1, 0, 0, 0}},
+		{"entry length past the end", []byte{TypeBatch, 1, 0, 0xff, 0xff, TypeDatagram}},
+		{"invalid datagram", []byte{TypeBatch, 1, 0, 1, 0, TypeHeartbeat}},
+	} {
+		if _, err := Decode(c.input); err == nil {
+			t.Fatalf("%s: batch decoded", c.name)
+		}
+	}
+}
+
+// pending returns a datagram of the given payload length, laid out as expected by WriteDatagram and BatchWriter
+func pending(length int) *Datagram {
+	buffer := mcache.Malloc(MaxDatagramPacketHeaderLen + length)
+	for i := range buffer[MaxDatagramPacketHeaderLen:] {
+		buffer[MaxDatagramPacketHeaderLen+i] = byte(i)
+	}
+	return &Datagram{
+		DatagramLength: uint16(length),
+		UdpIP:          net.ParseIP("232.1.1.1"),
+		UdpPort:        10101,
+		DatagramPacket: buffer,
+	}
+}
+
+func TestBatchWriter(t *testing.T) {
+	codec := frame.NewLargeFrameCodec()
+	for _, c := range []struct {
+		name    string
+		lengths []int
+		frames  []int // datagrams of each frame written, 0 for a datagram in its own frame
+	}{
+		{"flushed by count", []int{10, 10, 10, 10}, []int{3, 1}},
+		{"flushed by size", []int{400, 400, 400}, []int{2, 1}},
+		{"larger than a batch", []int{10, 2000, 10}, []int{1, 0, 1}},
+		{"larger than an entry", []int{10, MaxBatchEntryLen, 10}, []int{1, 0, 1}},
+	} {
+		var out bytes.Buffer
+		w := bufio.NewWriter(&out)
+		b := NewBatchWriter(codec, w, 1024, 3)
+		for _, l := range c.lengths {
+			if err := b.Add(pending(l)); err != nil {
+				t.Fatalf("%s: %s", c.name, err)
+			}
+		}
+		if err := b.Flush(); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		b.Release()
+
+		r := bufio.NewReader(&out)
+		next := 0
+		for i, count := range c.frames {
+			p, framePayload, err := ReadFrame(codec, r)
+			if err != nil {
+				t.Fatalf("%s: frame %d: %s", c.name, i, err)
+			}
+			var datagrams []*Datagram
+			switch p := p.(type) {
+			case *Batch:
+				datagrams = p.Datagrams
+			case *Datagram:
+				if count != 0 {
+					t.Fatalf("%s: frame %d: datagram, expected a batch", c.name, i)
+				}
+				datagrams = []*Datagram{p}
+				count = 1
+			}
+			if len(datagrams) != count {
+				t.Fatalf("%s: frame %d: [%d] datagrams, expected [%d]", c.name, i, len(datagrams), count)
+			}
+			for _, d := range datagrams {
+				if len(d.DatagramPacket) != c.lengths[next] {
+					t.Fatalf("%s: datagram %d: length [%d], expected [%d]", c.name, next, len(d.DatagramPacket),
+						c.lengths[next])
+				}
+				next++
+			}
+			mcache.Free(framePayload)
+		}
+		if out.Len() != 0 || r.Buffered() != 0 {
+			t.Fatalf("%s: unexpected frames", c.name)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package policy
+
+import (
+	"math"
+	"time"
+)
+
+// Limiter is a token bucket allowing a rate per second, with bursts up to one second of that rate. A request larger
+// than the rate is allowed on a full bucket, which goes in debt: the next requests wait for the time it would take at
+// that rate. It is not safe for concurrent use.
+type Limiter struct {
+	rate   float64
+	tokens float64 // negative when in debt
+	last   time.Time
+}
+
+// NewLimiter returns a limiter of the given rate per second, nil (unlimited) when the rate is zero
+func NewLimiter(rate float64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{rate: rate, tokens: rate}
+}
+
+// Allow consumes n tokens at the given time, if available. A nil limiter allows everything.
+func (l *Limiter) Allow(n float64, now time.Time) bool {
+	if !l.Available(n, now) {
+		return false
+	}
+	l.Take(n)
+	return true
+}
+
+// Available refills the bucket at the given time and tells whether a request of n tokens is allowed, without consuming
+// them. A nil limiter allows everything.
+func (l *Limiter) Available(n float64, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+	return l.tokens >= math.Min(n, l.rate)
+}
+
+// Take consumes n tokens once allowed, the bucket going in debt for a request larger than the rate
+func (l *Limiter) Take(n float64) {
+	if l != nil {
+		l.tokens -= n
+	}
+}
@@ -0,0 +1,93 @@
+package policy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterRate(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(10)
+	for i := 0; i < 10; i++ {
+		if !l.Allow(1, now) {
+			t.Fatalf("request %d refused within the burst", i)
+		}
+	}
+	if l.Allow(1, now) {
+		t.Fatal("request allowed over the burst")
+	}
+	if !l.Allow(1, now.Add(100*time.Millisecond)) {
+		t.Fatal("request refused after the refill")
+	}
+}
+
+func TestLimiterBurst(t *testing.T) {
+	// the burst is one second of a rate well below the largest datagram
+	now := time.Now()
+	l := NewLimiter(1000)
+	allowed := 0
+	for i := 0; i < 65; i++ {
+		if l.Allow(1000, now) {
+			allowed++
+		}
+	}
+	if allowed != 1 {
+		t.Fatalf("%d requests of 1000 allowed at once, expected 1", allowed)
+	}
+}
+
+func TestLimiterLargerThanRate(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(1000)
+	if !l.Allow(60000, now) {
+		t.Fatal("request larger than the rate refused on an idle limiter")
+	}
+	if l.Allow(1, now) {
+		t.Fatal("request allowed right after a request larger than the rate")
+	}
+	// the debt of 59000 takes 59 seconds at the rate
+	if l.Allow(1, now.Add(58*time.Second)) {
+		t.Fatal("request allowed before the debt is paid")
+	}
+	if !l.Allow(1000, now.Add(60*time.Second)) {
+		t.Fatal("request refused once the debt is paid")
+	}
+	if !l.Allow(60000, now.Add(time.Hour)) {
+		t.Fatal("request larger than the rate refused after an idle period")
+	}
+}
+
+func TestLimiterFractionalRate(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(0.5)
+	if !l.Allow(1, now) {
+		t.Fatal("request refused on an idle limiter")
+	}
+	if l.Allow(1, now.Add(time.Second)) {
+		t.Fatal("request allowed before the debt is paid")
+	}
+	if !l.Allow(1, now.Add(3*time.Second)) {
+		t.Fatal("request refused once the debt is paid")
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := NewLimiter(0)
+	if l != nil || !l.Allow(1e9, time.Now()) {
+		t.Fatal("unlimited limiter refused a request")
+	}
+}
+
+func TestLimiterAvailable(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(1)
+	for i := 0; i < 3; i++ {
+		if !l.Available(1, now) {
+			t.Fatal("token not available")
+		}
+	}
+	l.Take(1)
+	if l.Available(1, now) {
+		t.Fatal("token available once taken")
+	}
+}
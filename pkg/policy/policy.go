@@ -0,0 +1,201 @@
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/mgeri/udptunneler/pkg/route"
+	"github.com/mgeri/udptunneler/pkg/util"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// AnyClient is the selector of the rule applied to every client
+	AnyClient = "*"
+	// DenyGroups is the groups of the rules refusing every datagram
+	DenyGroups = "deny"
+)
+
+// Client is the identity of a connected client
+type Client struct {
+	Addr        net.IP // remote address of the connection
+	ClientID    string // client id, empty when not authenticated with a pre-shared key
+	TLSIdentity string // verified tls client certificate identity, empty without mutual TLS
+}
+
+// selector kinds
+const (
+	selectID   = "id"
+	selectTLS  = "tls"
+	selectAddr = "addr"
+)
+
+// Rule maps the selected clients to the groups they may publish to, and to their rate limits
+type Rule struct {
+	selector string
+	kind     string
+	value    string
+	network  *net.IPNet
+	Groups   []*route.Match // nil refuses every datagram
+	Rate     float64        // datagrams per second, 0 = unlimited
+	Bytes    float64        // bytes of datagrams per second, 0 = unlimited
+}
+
+func (r *Rule) selects(c *Client) bool {
+	switch r.kind {
+	case selectID:
+		return c.ClientID != "" && c.ClientID == r.value
+	case selectTLS:
+		return c.TLSIdentity != "" && c.TLSIdentity == r.value
+	case selectAddr:
+		return r.network.Contains(c.Addr)
+	default:
+		return true
+	}
+}
+
+// Allows tells whether the client may publish to the destination of a datagram
+func (r *Rule) Allows(ip net.IP, port int) bool {
+	for _, m := range r.Groups {
+		if m.Matches(ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) String() string {
+	groups := DenyGroups
+	if r.Groups != nil {
+		list := make([]string, 0, len(r.Groups))
+		for _, m := range r.Groups {
+			list = append(list, m.String())
+		}
+		groups = strings.Join(list, ",")
+	}
+	s := fmt.Sprintf("%s=%s", r.selector, groups)
+	if r.Rate > 0 {
+		s += fmt.Sprintf(" rate=%g", r.Rate)
+	}
+	if r.Bytes > 0 {
+		s += fmt.Sprintf(" bytes=%g", r.Bytes)
+	}
+	return s
+}
+
+// Policy is an ordered list of rules, the first rule selecting the client wins
+type Policy struct {
+	Rules []*Rule
+}
+
+// Lookup returns the first rule selecting the client, or nil when no rule selects it
+func (p *Policy) Lookup(c *Client) *Rule {
+	for _, r := range p.Rules {
+		if r.selects(c) {
+			return r
+		}
+	}
+	return nil
+}
+
+// ParseRule parses a rule in the form client=groups [rate=datagrams] [bytes=bytes], where:
+//   - client is "*", id:<client id>, tls:<certificate identity> or addr:ip[/bits]
+//   - groups is "deny", or the comma separated destinations of the datagrams as ip[/bits][:port[-port]]
+//     ([ip[/bits]][:port[-port]] for IPv6), "*" for any destination
+//   - rate and bytes are the max number of datagrams and of bytes per second of a connection
+func ParseRule(s string) (*Rule, error) {
+	clientStr, rest, found := strings.Cut(strings.TrimSpace(s), "=")
+	if !found {
+		return nil, fmt.Errorf("invalid policy [%s], expected client=groups", s)
+	}
+	r := &Rule{selector: strings.TrimSpace(clientStr)}
+	if err := r.parseSelector(); err != nil {
+		return nil, fmt.Errorf("invalid policy [%s]: %w", s, err)
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid policy [%s], expected client=groups", s)
+	}
+	if fields[0] != DenyGroups {
+		for _, gs := range strings.Split(fields[0], ",") {
+			m, err := route.ParseMatch(gs)
+			if err != nil {
+				return nil, fmt.Errorf("invalid policy [%s]: %w", s, err)
+			}
+			r.Groups = append(r.Groups, m)
+		}
+	}
+	for _, option := range fields[1:] {
+		key, value, _ := strings.Cut(option, "=")
+		limit, err := strconv.ParseFloat(value, 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid policy [%s]: invalid limit [%s]", s, option)
+		}
+		switch key {
+		case "rate":
+			r.Rate = limit
+		case "bytes":
+			r.Bytes = limit
+		default:
+			return nil, fmt.Errorf("invalid policy [%s]: unknown option [%s]", s, option)
+		}
+	}
+	return r, nil
+}
+
+func (r *Rule) parseSelector() error {
+	if r.selector == AnyClient {
+		return nil
+	}
+	kind, value, found := strings.Cut(r.selector, ":")
+	value = strings.TrimSpace(value)
+	if !found || value == "" {
+		return fmt.Errorf("invalid client [%s], expected *, id:<client id>, tls:<identity> or addr:<ip[/bits]>", r.selector)
+	}
+	r.kind, r.value = kind, value
+	switch kind {
+	case selectID, selectTLS:
+		return nil
+	case selectAddr:
+		nets, err := util.ParseCIDRs([]string{value})
+		if err != nil {
+			return err
+		}
+		r.network = nets[0]
+		return nil
+	default:
+		return fmt.Errorf("invalid client [%s], expected *, id:<client id>, tls:<identity> or addr:<ip[/bits]>", r.selector)
+	}
+}
+
+// LoadFile reads the policy from a file with one rule per line. Empty lines and lines starting with # are ignored.
+func LoadFile(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &Policy{}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		p.Rules = append(p.Rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
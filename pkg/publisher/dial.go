@@ -0,0 +1,74 @@
+package publisher
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+)
+
+// Options are the multicast options of the publishing sockets
+type Options struct {
+	Interface *net.Interface // outgoing interface, nil for the system default
+	TTL       int            // time to live of the IPv4 multicast datagrams
+	HopLimit  int            // hop limit of the IPv6 multicast datagrams
+	Loopback  bool           // loop back the multicast datagrams to the local receivers
+}
+
+// Dial opens the udp socket used to publish the datagrams to the given address.
+// Multicast sockets are bound to the outgoing interface, with the configured ttl (hop limit) and loopback.
+// The zone of the address, if any, overrides the outgoing interface.
+func (o *Options) Dial(addr *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp4"
+	if addr.IP.To4() == nil {
+		network = "udp6"
+		if addr.IP.IsMulticast() && addr.Zone == "" && o.Interface != nil {
+			addr = &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: o.Interface.Name}
+		}
+	}
+	c, err := net.DialUDP(network, nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP.IsMulticast() {
+		if err = o.setMulticastOptions(c, addr); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (o *Options) setMulticastOptions(c *net.UDPConn, addr *net.UDPAddr) error {
+	intf := o.Interface
+	if addr.Zone != "" {
+		var err error
+		intf, err = net.InterfaceByName(addr.Zone)
+		if err != nil {
+			return err
+		}
+	}
+
+	if addr.IP.To4() != nil {
+		pc := ipv4.NewPacketConn(c)
+		if intf != nil {
+			if err := pc.SetMulticastInterface(intf); err != nil {
+				return err
+			}
+		}
+		if err := pc.SetMulticastTTL(o.TTL); err != nil {
+			return err
+		}
+		return pc.SetMulticastLoopback(o.Loopback)
+	}
+
+	pc := ipv6.NewPacketConn(c)
+	if intf != nil {
+		if err := pc.SetMulticastInterface(intf); err != nil {
+			return err
+		}
+	}
+	if err := pc.SetMulticastHopLimit(o.HopLimit); err != nil {
+		return err
+	}
+	return pc.SetMulticastLoopback(o.Loopback)
+}
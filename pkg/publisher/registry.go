@@ -0,0 +1,216 @@
+package publisher
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DialFunc opens the udp socket publishing to the given address
+type DialFunc func(addr *net.UDPAddr) (*net.UDPConn, error)
+
+// Registry owns the udp sockets used to publish the datagrams, one for every destination address.
+// It is safe for concurrent use by many clients: sockets are shared between the clients publishing to the same
+// destination, are reference-counted per client, and closed once no client uses them for the idle timeout.
+type Registry struct {
+	dial        DialFunc
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*entry              // by destination address
+	clients map[string]map[string]struct{} // destination addresses referenced by every client
+	done    chan struct{}
+}
+
+type entry struct {
+	conn     *net.UDPConn // nil when only published without the registry sockets
+	refs     int
+	lastUsed time.Time
+	sent     uint64
+	errors   uint64
+}
+
+// Stats are the counters of a destination
+type Stats struct {
+	Destination string
+	Sent        uint64
+	Errors      uint64
+}
+
+// NewRegistry creates the registry, starting the idle sockets cleanup
+func NewRegistry(dial DialFunc, idleTimeout time.Duration) *Registry {
+	r := &Registry{
+		dial:        dial,
+		idleTimeout: idleTimeout,
+		entries:     make(map[string]*entry),
+		clients:     make(map[string]map[string]struct{}),
+		done:        make(chan struct{}),
+	}
+	go r.cleanup()
+	return r
+}
+
+// Get returns the socket publishing to addr on behalf of the client, opening it if needed.
+// The socket stays open at least until the client is released.
+func (r *Registry) Get(client string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	key := addr.String()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[key]
+	if !ok || e.conn == nil {
+		c, err := r.dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			e = &entry{}
+			r.entries[key] = e
+		}
+		e.conn = c
+		log.Printf("publisher[%s] opened", key)
+	}
+	r.reference(client, key, e)
+	return e.conn, nil
+}
+
+// reference records the use of the destination by the client, must be called with the lock held
+func (r *Registry) reference(client string, key string, e *entry) {
+	e.lastUsed = time.Now()
+	refs, ok := r.clients[client]
+	if !ok {
+		refs = make(map[string]struct{})
+		r.clients[client] = refs
+	}
+	if _, ok := refs[key]; !ok {
+		refs[key] = struct{}{}
+		e.refs++
+	}
+}
+
+// Write publishes the payload to addr on behalf of the client. Write errors are counted per destination, and
+// logged at a throttled rate.
+func (r *Registry) Write(client string, addr *net.UDPAddr, payload []byte) error {
+	c, err := r.Get(client, addr)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(payload)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.entries[addr.String()]; ok {
+		e.count(addr, err)
+	}
+	return err
+}
+
+// Account counts a datagram published to addr on behalf of the client without the sockets of the registry (e.g.
+// through a raw socket), with the outcome of its write. The destination is referenced by the client as with Write.
+func (r *Registry) Account(client string, addr *net.UDPAddr, err error) {
+	key := addr.String()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[key]
+	if !ok {
+		e = &entry{}
+		r.entries[key] = e
+	}
+	r.reference(client, key, e)
+	e.count(addr, err)
+}
+
+// count counts the outcome of a write, errors are logged at a throttled rate. Must be called with the lock held.
+func (e *entry) count(addr *net.UDPAddr, err error) {
+	if err != nil {
+		e.errors++
+		if e.errors&(e.errors-1) == 0 {
+			log.Printf("publisher[%s] write error: %v, %d errors so far", addr, err, e.errors)
+		}
+		return
+	}
+	e.sent++
+}
+
+// Stats returns the counters of the destinations in use
+func (r *Registry) Stats() []Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make([]Stats, 0, len(r.entries))
+	for key, e := range r.entries {
+		stats = append(stats, Stats{Destination: key, Sent: e.sent, Errors: e.errors})
+	}
+	return stats
+}
+
+// Release drops all the references of the client, usually when it disconnects
+func (r *Registry) Release(client string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key := range r.clients[client] {
+		if e, ok := r.entries[key]; ok {
+			e.refs--
+		}
+	}
+	delete(r.clients, client)
+	r.closeIdle(time.Now())
+}
+
+// Len returns the number of destinations in use, with or without an open socket
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.entries)
+}
+
+// Close closes all the sockets and stops the cleanup
+func (r *Registry) Close() {
+	close(r.done)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, e := range r.entries {
+		if e.conn != nil {
+			e.conn.Close()
+		}
+		delete(r.entries, key)
+	}
+	r.clients = make(map[string]map[string]struct{})
+}
+
+func (r *Registry) cleanup() {
+	interval := r.idleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			r.mu.Lock()
+			r.closeIdle(now)
+			r.mu.Unlock()
+		}
+	}
+}
+
+// closeIdle closes the sockets not referenced by any client and unused for the idle timeout, must be called with the lock held
+func (r *Registry) closeIdle(now time.Time) {
+	for key, e := range r.entries {
+		if e.refs > 0 || now.Sub(e.lastUsed) < r.idleTimeout {
+			continue
+		}
+		if e.conn != nil {
+			e.conn.Close()
+		}
+		delete(r.entries, key)
+		log.Printf("publisher[%s] closed (%d sent, %d errors)", key, e.sent, e.errors)
+	}
+}
@@ -0,0 +1,169 @@
+package publisher
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listen opens the local udp sockets receiving the published datagrams
+func listen(t *testing.T, n int) []*net.UDPAddr {
+	t.Helper()
+	addrs := make([]*net.UDPAddr, n)
+	for i := range addrs {
+		c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		addrs[i] = c.LocalAddr().(*net.UDPAddr)
+	}
+	return addrs
+}
+
+func dial(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return net.DialUDP("udp4", nil, addr)
+}
+
+// refs returns the number of clients referencing the destination, -1 when not open
+func refs(r *Registry, addr *net.UDPAddr) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[addr.String()]
+	if !ok {
+		return -1
+	}
+	return e.refs
+}
+
+func TestRegistryConcurrentClients(t *testing.T) {
+	const (
+		clients = 50
+		writes  = 20
+	)
+	dsts := listen(t, 4)
+	r := NewRegistry(dial, time.Minute)
+	defer r.Close()
+
+	// every client writes to every destination, then waits for the others before being released
+	var written, released sync.WaitGroup
+	written.Add(clients)
+	released.Add(clients)
+	release := make(chan struct{})
+	for i := 0; i < clients; i++ {
+		client := fmt.Sprintf("client-%d", i)
+		go func() {
+			defer released.Done()
+			for j := 0; j < writes; j++ {
+				for _, dst := range dsts {
+					if err := r.Write(client, dst, []byte(client)); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+			written.Done()
+			<-release
+			r.Release(client)
+		}()
+	}
+
+	written.Wait()
+	if r.Len() != len(dsts) {
+		t.Fatalf("%d sockets open, expected %d", r.Len(), len(dsts))
+	}
+	for _, dst := range dsts {
+		if n := refs(r, dst); n != clients {
+			t.Errorf("destination %s referenced by %d clients, expected %d", dst, n, clients)
+		}
+	}
+	for _, s := range r.Stats() {
+		if s.Sent != clients*writes || s.Errors != 0 {
+			t.Errorf("destination %s: %d sent, %d errors, expected %d sent", s.Destination, s.Sent, s.Errors, clients*writes)
+		}
+	}
+
+	close(release)
+	released.Wait()
+	for _, dst := range dsts {
+		// recently used, left open for the idle timeout
+		if n := refs(r, dst); n != 0 {
+			t.Errorf("destination %s referenced by %d clients once released, expected none", dst, n)
+		}
+	}
+}
+
+func TestRegistryIdleTimeout(t *testing.T) {
+	const idleTimeout = 50 * time.Millisecond
+	dsts := listen(t, 1)
+	dst := dsts[0]
+	r := NewRegistry(dial, idleTimeout)
+	defer r.Close()
+
+	c, err := r.Get("client-a", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Get("client-b", dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// still referenced by client-b after the idle timeout
+	r.Release("client-a")
+	time.Sleep(2 * idleTimeout)
+	r.mu.Lock()
+	r.closeIdle(time.Now())
+	r.mu.Unlock()
+	if n := refs(r, dst); n != 1 {
+		t.Fatalf("destination referenced by %d clients, expected 1", n)
+	}
+	if _, err = c.Write([]byte("open")); err != nil {
+		t.Fatalf("socket referenced by a client closed: %s", err)
+	}
+
+	// no longer referenced and idle
+	r.Release("client-b")
+	if r.Len() != 0 {
+		t.Fatalf("%d sockets open, expected none", r.Len())
+	}
+	if _, err = c.Write([]byte("closed")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("idle socket not closed, write error: %v", err)
+	}
+}
+
+func TestRegistryReleaseBeforeIdleTimeout(t *testing.T) {
+	dsts := listen(t, 1)
+	r := NewRegistry(dial, time.Minute)
+	defer r.Close()
+
+	if err := r.Write("client-a", dsts[0], []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	r.Release("client-a")
+	if n := refs(r, dsts[0]); n != 0 {
+		t.Fatalf("released destination referenced by %d clients (-1 = closed), expected open and unreferenced", n)
+	}
+}
+
+func TestRegistryAccount(t *testing.T) {
+	dsts := listen(t, 1)
+	dst := dsts[0]
+	r := NewRegistry(dial, time.Minute)
+	defer r.Close()
+
+	// published without the socket of the registry, then with it
+	r.Account("client-a", dst, nil)
+	r.Account("client-a", dst, errors.New("write error"))
+	if err := r.Write("client-b", dst, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	stats := r.Stats()
+	if len(stats) != 1 || stats[0].Sent != 2 || stats[0].Errors != 1 {
+		t.Fatalf("stats %+v, expected 2 sent and 1 error", stats)
+	}
+	if n := refs(r, dst); n != 2 {
+		t.Fatalf("destination referenced by %d clients, expected 2", n)
+	}
+}
@@ -0,0 +1,89 @@
+package queue
+
+import (
+	"fmt"
+	"github.com/bytedance/gopkg/lang/mcache"
+	"github.com/mgeri/udptunneler/pkg/packet"
+	"log"
+	"sync/atomic"
+)
+
+// Policies applied when the queue is full
+const (
+	PolicyDropOldest = "drop-oldest"
+	PolicyDropNewest = "drop-newest"
+)
+
+// Queue is the bounded queue of the datagrams waiting to be sent to the peer.
+// It keeps buffering while the peer is slow or unreachable, dropping datagrams according to the policy once full.
+type Queue struct {
+	C          chan *packet.Datagram
+	dropOldest bool
+	dropped    uint64
+}
+
+// New creates a queue holding up to size datagrams
+func New(size int, policy string) (*Queue, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid queue size [%d]", size)
+	}
+	q := &Queue{
+		C: make(chan *packet.Datagram, size),
+	}
+	switch policy {
+	case PolicyDropOldest:
+		q.dropOldest = true
+	case PolicyDropNewest:
+		q.dropOldest = false
+	default:
+		return nil, fmt.Errorf("invalid queue policy [%s], expected %s or %s", policy, PolicyDropOldest, PolicyDropNewest)
+	}
+	return q, nil
+}
+
+// Push enqueues the datagram without blocking, dropping a datagram when the queue is full
+func (q *Queue) Push(d *packet.Datagram) {
+	for {
+		select {
+		case q.C <- d:
+			return
+		default:
+		}
+
+		if !q.dropOldest {
+			q.release(d)
+			return
+		}
+		select {
+		case old := <-q.C:
+			q.release(old)
+		default:
+		}
+	}
+}
+
+// Dropped returns the number of datagrams dropped so far
+func (q *Queue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Drain releases the datagrams still queued, once the queue is no longer consumed
+func (q *Queue) Drain() {
+	for {
+		select {
+		case d := <-q.C:
+			mcache.Free(d.DatagramPacket)
+		default:
+			return
+		}
+	}
+}
+
+func (q *Queue) release(d *packet.Datagram) {
+	mcache.Free(d.DatagramPacket)
+	n := atomic.AddUint64(&q.dropped, 1)
+	// avoid flooding the log while the peer is unreachable
+	if n&(n-1) == 0 {
+		log.Printf("queue full, %d datagrams dropped so far", n)
+	}
+}
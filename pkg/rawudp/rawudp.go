@@ -0,0 +1,85 @@
+// Package rawudp publishes udp datagrams through a raw socket, building the IP and UDP headers so that the datagrams
+// keep the source address of the host which originally published them.
+package rawudp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	IPv4HeaderLen = 20
+	UDPHeaderLen  = 8
+
+	DefaultTTL        = 1
+	DefaultUnicastTTL = 64
+)
+
+var (
+	ErrNotSupported = errors.New("raw socket publisher is supported on linux only")
+	ErrNotIPv4      = errors.New("raw socket publisher supports IPv4 addresses only")
+)
+
+// encode builds the IPv4 and UDP headers of the datagram in buffer, which must be long enough to contain both headers
+// followed by the payload
+func encode(buffer []byte, payload []byte, src, dst *net.UDPAddr, ttl int) ([]byte, error) {
+	src4 := src.IP.To4()
+	dst4 := dst.IP.To4()
+	if src4 == nil || dst4 == nil {
+		return nil, ErrNotIPv4
+	}
+	totalLen := IPv4HeaderLen + UDPHeaderLen + len(payload)
+	if totalLen > 0xffff {
+		return nil, errors.New("datagram too long")
+	}
+	pkt := buffer[:totalLen]
+
+	// ip header, checksum is computed by the kernel
+	ip := pkt[:IPv4HeaderLen]
+	ip[0] = 0x45 // version 4, header length 5 words
+	ip[1] = 0    // tos
+	binary.BigEndian.PutUint16(ip[2:4], uint16(totalLen))
+	binary.BigEndian.PutUint16(ip[4:6], 0) // id, filled by the kernel
+	binary.BigEndian.PutUint16(ip[6:8], 0) // flags and fragment offset
+	ip[8] = uint8(ttl)
+	ip[9] = 17 // udp
+	binary.BigEndian.PutUint16(ip[10:12], 0)
+	copy(ip[12:16], src4)
+	copy(ip[16:20], dst4)
+
+	// udp header
+	udp := pkt[IPv4HeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(UDPHeaderLen+len(payload)))
+	binary.BigEndian.PutUint16(udp[6:8], 0)
+	copy(udp[UDPHeaderLen:], payload)
+	binary.BigEndian.PutUint16(udp[6:8], udpChecksum(src4, dst4, udp))
+
+	return pkt, nil
+}
+
+// udpChecksum computes the udp checksum, including the IPv4 pseudo header
+func udpChecksum(src, dst net.IP, udp []byte) uint16 {
+	var sum uint32
+	sum += uint32(binary.BigEndian.Uint16(src[0:2])) + uint32(binary.BigEndian.Uint16(src[2:4]))
+	sum += uint32(binary.BigEndian.Uint16(dst[0:2])) + uint32(binary.BigEndian.Uint16(dst[2:4]))
+	sum += 17
+	sum += uint32(len(udp))
+	for i := 0; i+1 < len(udp); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(udp[i : i+2]))
+	}
+	if len(udp)%2 == 1 {
+		sum += uint32(udp[len(udp)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	csum := ^uint16(sum)
+	if csum == 0 {
+		// zero means no checksum
+		csum = 0xffff
+	}
+	return csum
+}
@@ -0,0 +1,74 @@
+//go:build linux
+
+package rawudp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bytedance/gopkg/lang/mcache"
+	"net"
+	"syscall"
+)
+
+// Conn is a raw IPv4 socket with IP_HDRINCL
+type Conn struct {
+	fd  int
+	TTL int // ttl of the multicast datagrams
+}
+
+// Open opens the raw socket, which requires the CAP_NET_RAW capability
+func Open() (*Conn, error) {
+	// IPPROTO_RAW implies IP_HDRINCL
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+			return nil, fmt.Errorf("raw socket publisher requires the CAP_NET_RAW capability "+
+				"(run as root or grant it with 'setcap cap_net_raw+ep udptunneler'): %w", err)
+		}
+		return nil, fmt.Errorf("failed to open raw socket: %w", err)
+	}
+	return &Conn{fd: fd, TTL: DefaultTTL}, nil
+}
+
+// WriteTo sends the payload to dst with src as source address and port
+func (c *Conn) WriteTo(payload []byte, src, dst *net.UDPAddr) error {
+	buffer := mcache.Malloc(IPv4HeaderLen + UDPHeaderLen + len(payload))
+	defer mcache.Free(buffer)
+
+	ttl := DefaultUnicastTTL
+	if dst.IP.IsMulticast() {
+		ttl = c.TTL
+	}
+	pkt, err := encode(buffer, payload, src, dst, ttl)
+	if err != nil {
+		return err
+	}
+	sa := &syscall.SockaddrInet4{}
+	copy(sa.Addr[:], dst.IP.To4())
+	return syscall.Sendto(c.fd, pkt, 0, sa)
+}
+
+// SetMulticastOptions sets the outgoing interface (nil means the system default), the ttl and the loopback of the
+// multicast datagrams
+func (c *Conn) SetMulticastOptions(intf *net.Interface, ttl int, loopback bool) error {
+	if intf != nil {
+		mreq := &syscall.IPMreqn{Ifindex: int32(intf.Index)}
+		if err := syscall.SetsockoptIPMreqn(c.fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, mreq); err != nil {
+			return fmt.Errorf("failed to set raw socket multicast interface: %w", err)
+		}
+	}
+	loop := 0
+	if loopback {
+		loop = 1
+	}
+	if err := syscall.SetsockoptInt(c.fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, loop); err != nil {
+		return fmt.Errorf("failed to set raw socket multicast loopback: %w", err)
+	}
+	c.TTL = ttl
+	return nil
+}
+
+// Close closes the raw socket
+func (c *Conn) Close() error {
+	return syscall.Close(c.fd)
+}
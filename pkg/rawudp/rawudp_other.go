@@ -0,0 +1,32 @@
+//go:build !linux
+
+package rawudp
+
+import (
+	"net"
+)
+
+// Conn is a raw IPv4 socket with IP_HDRINCL
+type Conn struct {
+	TTL int // ttl of the multicast datagrams
+}
+
+// Open opens the raw socket, which is supported on linux only
+func Open() (*Conn, error) {
+	return nil, ErrNotSupported
+}
+
+// WriteTo sends the payload to dst with src as source address and port
+func (c *Conn) WriteTo(payload []byte, src, dst *net.UDPAddr) error {
+	return ErrNotSupported
+}
+
+// SetMulticastOptions sets the outgoing interface, the ttl and the loopback of the multicast datagrams
+func (c *Conn) SetMulticastOptions(intf *net.Interface, ttl int, loopback bool) error {
+	return ErrNotSupported
+}
+
+// Close closes the raw socket
+func (c *Conn) Close() error {
+	return nil
+}
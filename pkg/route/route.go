@@ -0,0 +1,293 @@
+package route
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultMatch is the match of the rule applied to every datagram
+	DefaultMatch = "default"
+	// DropTarget is the target of the rules discarding the datagrams
+	DropTarget = "drop"
+)
+
+// Match selects the datagrams by destination group and port. A nil network matches any group.
+type Match struct {
+	Network *net.IPNet
+	PortMin int
+	PortMax int
+}
+
+// Matches tells whether the destination of a datagram is matched
+func (m *Match) Matches(ip net.IP, port int) bool {
+	if m.Network != nil && !m.Network.Contains(ip) {
+		return false
+	}
+	return port >= m.PortMin && port <= m.PortMax
+}
+
+func (m *Match) String() string {
+	network := "*"
+	if m.Network != nil {
+		network = m.Network.String()
+	}
+	if m.PortMin == 0 && m.PortMax == 0xffff {
+		return network
+	}
+	if m.PortMin == m.PortMax {
+		return fmt.Sprintf("%s:%d", network, m.PortMin)
+	}
+	return fmt.Sprintf("%s:%d-%d", network, m.PortMin, m.PortMax)
+}
+
+// Target is the destination where the matched datagrams are published.
+// A zero port keeps the original port, and the interface is carried as the zone of the address.
+type Target struct {
+	Addr *net.UDPAddr
+}
+
+// Destination returns the address where a datagram sent to the given port is published
+func (t *Target) Destination(port int) *net.UDPAddr {
+	if t.Addr.Port != 0 {
+		return t.Addr
+	}
+	return &net.UDPAddr{IP: t.Addr.IP, Port: port, Zone: t.Addr.Zone}
+}
+
+func (t *Target) String() string {
+	if t.Addr.Port != 0 {
+		return t.Addr.String()
+	}
+	// original port kept
+	host := t.Addr.IP.String()
+	if t.Addr.Zone != "" {
+		host += "%" + t.Addr.Zone
+	}
+	if t.Addr.IP.To4() == nil {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// Rule maps the matched datagrams to the targets, every datagram is published to all of them (fan-out).
+// A rule without targets drops the datagrams.
+type Rule struct {
+	Match   Match
+	Targets []*Target
+}
+
+// Destinations returns the addresses where a datagram sent to the given port is published
+func (r *Rule) Destinations(port int) []*net.UDPAddr {
+	dsts := make([]*net.UDPAddr, 0, len(r.Targets))
+	for _, t := range r.Targets {
+		dsts = append(dsts, t.Destination(port))
+	}
+	return dsts
+}
+
+func (r *Rule) String() string {
+	if len(r.Targets) == 0 {
+		return fmt.Sprintf("%s=%s", &r.Match, DropTarget)
+	}
+	targets := make([]string, 0, len(r.Targets))
+	for _, t := range r.Targets {
+		targets = append(targets, t.String())
+	}
+	return fmt.Sprintf("%s=%s", &r.Match, strings.Join(targets, ","))
+}
+
+// Table is an ordered list of rules, the first matching rule wins
+type Table struct {
+	Rules []*Rule
+}
+
+// Lookup returns the first rule matching the datagram destination, or nil when no rule matches
+func (t *Table) Lookup(ip net.IP, port int) *Rule {
+	for _, r := range t.Rules {
+		if r.Match.Matches(ip, port) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Add appends the rules to the table
+func (t *Table) Add(rules ...*Rule) {
+	t.Rules = append(t.Rules, rules...)
+}
+
+// ParseRule parses a rule in the form match=target[,target...], where:
+//   - match is "default", or ip[/bits][:port[-port]] ([ip[/bits]][:port[-port]] for IPv6)
+//   - target is "drop", or ip[:port][@interface] ([ip][:port][@interface] for IPv6), omitting the port to keep the original one.
+//     Multicast and unicast targets can be mixed.
+func ParseRule(s string) (*Rule, error) {
+	matchStr, targetStr, found := strings.Cut(strings.TrimSpace(s), "=")
+	if !found {
+		return nil, fmt.Errorf("invalid route [%s], expected match=target", s)
+	}
+	match, err := ParseMatch(strings.TrimSpace(matchStr))
+	if err != nil {
+		return nil, fmt.Errorf("invalid route [%s]: %w", s, err)
+	}
+	r := &Rule{Match: *match}
+	targetStr = strings.TrimSpace(targetStr)
+	if targetStr == DropTarget {
+		return r, nil
+	}
+	for _, ts := range strings.Split(targetStr, ",") {
+		t, err := parseTarget(strings.TrimSpace(ts))
+		if err != nil {
+			return nil, fmt.Errorf("invalid route [%s]: %w", s, err)
+		}
+		r.Targets = append(r.Targets, t)
+	}
+	return r, nil
+}
+
+// ParseRules parses a list of rules, see ParseRule
+func ParseRules(list []string) ([]*Rule, error) {
+	var rules []*Rule
+	for _, s := range list {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// LoadFile reads the rules from a file with one rule per line. Empty lines and lines starting with # are ignored.
+func LoadFile(path string) ([]*Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []*Rule
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		rules = append(rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// ParseMatch parses a match in the form "default", or ip[/bits][:port[-port]] ([ip[/bits]][:port[-port]] for IPv6)
+func ParseMatch(s string) (*Match, error) {
+	m := &Match{PortMin: 0, PortMax: 0xffff}
+	if s == DefaultMatch || s == "*" {
+		return m, nil
+	}
+
+	host, ports, err := splitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" && host != "*" {
+		if !strings.Contains(host, "/") {
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address [%s]", host)
+			}
+			if ip.To4() != nil {
+				host += "/32"
+			} else {
+				host += "/128"
+			}
+		}
+		_, m.Network, err = net.ParseCIDR(host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ports != "" && ports != "*" {
+		minStr, maxStr, isRange := strings.Cut(ports, "-")
+		m.PortMin, err = parsePort(minStr)
+		if err != nil {
+			return nil, err
+		}
+		m.PortMax = m.PortMin
+		if isRange {
+			m.PortMax, err = parsePort(maxStr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if m.PortMin > m.PortMax {
+			return nil, fmt.Errorf("invalid port range [%s]", ports)
+		}
+	}
+	return m, nil
+}
+
+func parseTarget(s string) (*Target, error) {
+	address, intf, _ := strings.Cut(s, "@")
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid target address [%s]", host)
+	}
+	addr := &net.UDPAddr{IP: ip, Zone: intf}
+	if port != "" {
+		addr.Port, err = parsePort(port)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if intf != "" {
+		if _, err := net.InterfaceByName(intf); err != nil {
+			return nil, fmt.Errorf("invalid interface [%s]: %w", intf, err)
+		}
+	}
+	return &Target{Addr: addr}, nil
+}
+
+// splitHostPort splits host[:port] or [host][:port], the port being optional
+func splitHostPort(s string) (string, string, error) {
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return "", "", fmt.Errorf("missing ']' in [%s]", s)
+		}
+		host, rest := s[1:end], s[end+1:]
+		if rest == "" {
+			return host, "", nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("invalid address [%s]", s)
+		}
+		return host, rest[1:], nil
+	}
+	host, port, _ := strings.Cut(s, ":")
+	return host, port, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port <= 0 || port > 0xffff {
+		return 0, fmt.Errorf("invalid port [%s]", s)
+	}
+	return port, nil
+}
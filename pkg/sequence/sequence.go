@@ -0,0 +1,64 @@
+package sequence
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Counter assigns the sequence numbers of a stream of datagrams. It is safe for concurrent use.
+type Counter struct {
+	next uint32
+}
+
+// Next returns the sequence number of the next datagram of the stream
+func (c *Counter) Next() uint32 {
+	return atomic.AddUint32(&c.next, 1) - 1
+}
+
+// Stats are the counters of a stream of datagrams
+type Stats struct {
+	Received   uint64 // datagrams received
+	Lost       uint64 // datagrams missing from the stream, not received yet
+	OutOfOrder uint64 // datagrams received late or duplicated, after a datagram with a greater sequence number
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d received, %d lost, %d out of order", s.Received, s.Lost, s.OutOfOrder)
+}
+
+// Tracker detects the gaps and the out of order arrivals in a stream of sequence numbers.
+// The first sequence number tracked is the start of the stream, wrap around is supported.
+type Tracker struct {
+	Stats
+	started bool
+	next    uint32
+}
+
+// Track accounts the sequence number of a received datagram.
+// It returns the number of datagrams found missing by this datagram, or -1 when the datagram is out of order.
+func (t *Tracker) Track(seq uint32) int64 {
+	t.Received++
+	if !t.started {
+		t.started = true
+		t.next = seq + 1
+		return 0
+	}
+
+	diff := int32(seq - t.next)
+	switch {
+	case diff == 0:
+		t.next++
+		return 0
+	case diff > 0:
+		t.Lost += uint64(diff)
+		t.next = seq + 1
+		return int64(diff)
+	default:
+		// late datagrams were accounted as lost
+		t.OutOfOrder++
+		if t.Lost > 0 {
+			t.Lost--
+		}
+		return -1
+	}
+}
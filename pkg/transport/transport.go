@@ -0,0 +1,205 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/quic-go/quic-go"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Schemes of the server addresses
+const (
+	SchemeTCP  = "tcp"
+	SchemeQUIC = "quic"
+)
+
+// ALPN is the application protocol negotiated by the QUIC connections
+const ALPN = "udptunneler"
+
+const (
+	// MaxStreams is the max number of unidirectional streams opened by a client, one per group
+	MaxStreams = 1024
+	// idleTimeout closes the QUIC connections of the vanished peers, the heartbeats detect them much earlier
+	idleTimeout = time.Minute
+)
+
+// ParseAddress splits a server address in the form [scheme://]host:port, where the scheme is tcp (default) or quic
+func ParseAddress(s string) (scheme string, address string, err error) {
+	scheme, address, found := strings.Cut(s, "://")
+	if !found {
+		scheme, address = SchemeTCP, s
+	}
+	if scheme != SchemeTCP && scheme != SchemeQUIC {
+		return "", "", fmt.Errorf("invalid server address [%s], unknown scheme [%s], expected tcp or quic", s, scheme)
+	}
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("invalid server address [%s]: %w", s, err)
+	}
+	return scheme, address, nil
+}
+
+func config() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout:  10 * time.Second,
+		MaxIdleTimeout:        idleTimeout,
+		MaxIncomingUniStreams: MaxStreams,
+		EnableDatagrams:       true,
+	}
+}
+
+func tlsConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	config.NextProtos = []string{ALPN}
+	return config
+}
+
+// Conn is a QUIC connection seen as a net.Conn through its control stream, the first bidirectional stream opened by
+// the client. It carries the handshake, the heartbeats and the frames not sent on the other streams of the connection.
+type Conn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+// Dial connects to the QUIC server and opens the control stream
+func Dial(address string, tlsConf *tls.Config, timeout time.Duration) (*Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, address, tlsConfig(tlsConf), config())
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return &Conn{Stream: stream, conn: conn}, nil
+}
+
+// Read reads from the control stream, the connection closed by the peer is reported as io.EOF
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Stream.Read(b)
+	return n, closedAsEOF(err)
+}
+
+// closedAsEOF translates the connection closed by the peer without error into io.EOF
+func closedAsEOF(err error) error {
+	var ae *quic.ApplicationError
+	if errors.As(err, &ae) && ae.Remote && ae.ErrorCode == 0 {
+		return io.EOF
+	}
+	return err
+}
+
+// eofReader is a stream reporting the connection closed by the peer as io.EOF
+type eofReader struct {
+	r io.Reader
+}
+
+func (r eofReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	return n, closedAsEOF(err)
+}
+
+// LocalAddr returns the local address of the connection
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the whole connection, with its streams
+func (c *Conn) Close() error {
+	return c.conn.CloseWithError(0, "")
+}
+
+// ConnectionState returns the state of the tls handshake of the connection
+func (c *Conn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// Done is closed when the connection is closed
+func (c *Conn) Done() <-chan struct{} {
+	return c.conn.Context().Done()
+}
+
+// OpenStream opens a unidirectional stream to the peer, without waiting when the peer does not allow more streams
+func (c *Conn) OpenStream() (io.WriteCloser, error) {
+	return c.conn.OpenUniStream()
+}
+
+// AcceptStream waits for the next unidirectional stream opened by the peer
+func (c *Conn) AcceptStream() (io.Reader, error) {
+	s, err := c.conn.AcceptUniStream(context.Background())
+	if err != nil {
+		return nil, closedAsEOF(err)
+	}
+	return eofReader{r: s}, nil
+}
+
+// SendDatagram sends the payload as an unreliable QUIC datagram. The payload is copied.
+// Payloads too large for a QUIC datagram are refused with an error.
+func (c *Conn) SendDatagram(payload []byte) error {
+	return c.conn.SendDatagram(payload)
+}
+
+// ReceiveDatagram waits for the next QUIC datagram sent by the peer
+func (c *Conn) ReceiveDatagram() ([]byte, error) {
+	b, err := c.conn.ReceiveDatagram(context.Background())
+	return b, closedAsEOF(err)
+}
+
+// Listener accepts the QUIC connections of the clients
+type Listener struct {
+	l *quic.Listener
+}
+
+// Listen listens to the QUIC connections on the udp address
+func Listen(address string, tlsConf *tls.Config) (*Listener, error) {
+	l, err := quic.ListenAddr(address, tlsConfig(tlsConf), config())
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{l: l}, nil
+}
+
+// Accept waits for the next connection, once its tls handshake is completed. The control stream has to be accepted
+// with AcceptControl before using the connection.
+func (l *Listener) Accept() (*Conn, error) {
+	conn, err := l.l.Accept(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn}, nil
+}
+
+// AcceptControl waits for the control stream opened by the client, closing the connection if not opened in time
+func (c *Conn) AcceptControl(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stream, err := c.conn.AcceptStream(ctx)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	c.Stream = stream
+	return nil
+}
+
+// Close stops listening, the accepted connections are not closed
+func (l *Listener) Close() error {
+	return l.l.Close()
+}
+
+// Addr returns the udp address of the listener
+func (l *Listener) Addr() net.Addr {
+	return l.l.Addr()
+}
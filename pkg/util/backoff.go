@@ -0,0 +1,45 @@
+package util
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponential delays between retries, with optional random jitter
+type Backoff struct {
+	Min    time.Duration // delay before the first retry
+	Max    time.Duration // upper bound of the delay
+	Factor float64       // multiplier applied at every attempt
+	Jitter float64       // random fraction (0..1) added or subtracted to the delay
+
+	attempt int
+}
+
+// Next returns the delay to wait before the next retry
+func (b *Backoff) Next() time.Duration {
+	factor := b.Factor
+	if factor < 1 {
+		factor = 2
+	}
+	d := float64(b.Min)
+	for i := 0; i < b.attempt && d < float64(b.Max); i++ {
+		d *= factor
+	}
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	b.attempt++
+
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// Reset restarts the backoff from the minimum delay
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
@@ -16,3 +16,15 @@ func SetReceiveBuffer(c net.PacketConn, receiveBufferSize int) error {
 	}
 	return nil
 }
+
+// AddrIP returns the ip of a tcp or udp address, nil for the other addresses
+func AddrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}